@@ -0,0 +1,88 @@
+package grpcpool
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// GetForKey is like Get, but tries to hand out the same client to all the
+// callers passing the same key, so that successive requests of a session land
+// on the same connection. The affinity is best effort: if the client of the
+// key is checked out, unhealthy or was recycled, another client is handed out
+// and becomes the client of the key. The keys of a client are forgotten when
+// it gets recycled, so they only live as long as their connection.
+func (p *Pool) GetForKey(ctx context.Context, key string) (c *ClientConn, err error) {
+	defer func() {
+		err = p.named(err)
+	}()
+
+	clients := p.initClients()
+	if clients == nil {
+		return nil, ErrClosed
+	}
+
+	wait, stop := p.getWait()
+	defer stop()
+	if err := p.waitResumed(ctx, wait); err != nil {
+		return nil, err
+	}
+
+	if cc := p.affineConn(key); cc != nil {
+		wrapper, ok := clients.take(func(c ClientConn) bool {
+			return c.ClientConn == cc
+		})
+		if ok {
+			c, err = p.checkout(ctx, clients, wrapper, 0)
+		}
+	}
+	if c == nil {
+		c, err = p.get(ctx, wait, false)
+	}
+	if err == nil {
+		p.setAffinity(key, c.ClientConn)
+	}
+	return c, err
+}
+
+// affineConn returns the healthy connection the key points to, if any
+func (p *Pool) affineConn(key string) *grpc.ClientConn {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	cc, ok := p.affinity[key]
+	if !ok {
+		return nil
+	}
+	if r, ok := p.conns[cc]; !ok || r.unhealthy {
+		return nil
+	}
+	return cc
+}
+
+// setAffinity points the key to the given connection
+func (p *Pool) setAffinity(key string, cc *grpc.ClientConn) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	if p.affinity[key] == cc {
+		return
+	}
+	r, ok := p.conns[cc]
+	if !ok {
+		return
+	}
+	if old, ok := p.conns[p.affinity[key]]; ok {
+		for i, k := range old.keys {
+			if k == key {
+				old.keys = append(old.keys[:i], old.keys[i+1:]...)
+				break
+			}
+		}
+	}
+	if p.affinity == nil {
+		p.affinity = make(map[string]*grpc.ClientConn)
+	}
+	p.affinity[key] = cc
+	r.keys = append(r.keys, key)
+}
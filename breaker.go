@@ -0,0 +1,51 @@
+package grpcpool
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker around the factory. After threshold
+// consecutive failures it opens and rejects the dials for the cooldown
+// duration, then lets a single probe dial through: the breaker closes again
+// if it succeeds, and stays open for another cooldown otherwise.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow returns whether a dial can be attempted at the given time
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || now.Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the outcome of a dial allowed by the breaker
+func (b *breaker) done(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = now
+	}
+}
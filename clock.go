@@ -0,0 +1,24 @@
+package grpcpool
+
+import (
+	"time"
+)
+
+// clock is the source of time of the pool, so that tests can control it
+type clock interface {
+	Now() time.Time
+}
+
+// realClock is the clock used by default, reading the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// withClock replaces the clock of the pool. It's only meant for tests
+func withClock(c clock) Option {
+	return func(p *Pool) {
+		p.clock = c
+	}
+}
@@ -0,0 +1,378 @@
+package grpcpool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Config holds the usual settings of a pool, for the applications loading
+// them from a configuration file. See NewFromConfig. In JSON, the durations
+// are either strings such as "30s", parsed with time.ParseDuration, or
+// integer nanoseconds
+type Config struct {
+	// Name is the WithName name of the pool, if any
+	Name string `json:"name" yaml:"name"`
+	// Capacity is the maximum number of clients
+	Capacity int `json:"capacity" yaml:"capacity"`
+	// InitialConns is the number of clients created with the pool
+	InitialConns int `json:"initial_conns" yaml:"initial_conns"`
+	// IdleTimeout is the duration after which an idle client is recycled,
+	// 0 to disable it
+	IdleTimeout time.Duration `json:"idle_timeout" yaml:"idle_timeout"`
+	// MaxLife is the duration after which a client is recycled, 0 to
+	// disable it
+	MaxLife time.Duration `json:"max_life" yaml:"max_life"`
+	// DialTimeout bounds each factory call, 0 to leave it unbounded
+	DialTimeout time.Duration `json:"dial_timeout" yaml:"dial_timeout"`
+}
+
+// UnmarshalJSON decodes the settings, accepting the durations as strings
+func (c *Config) UnmarshalJSON(data []byte) error {
+	// plain has the fields of Config without its methods, its durations
+	// being shadowed by the ones accepting strings
+	type plain Config
+	v := struct {
+		*plain
+		IdleTimeout jsonDuration `json:"idle_timeout"`
+		MaxLife     jsonDuration `json:"max_life"`
+		DialTimeout jsonDuration `json:"dial_timeout"`
+	}{
+		plain:       (*plain)(c),
+		IdleTimeout: jsonDuration(c.IdleTimeout),
+		MaxLife:     jsonDuration(c.MaxLife),
+		DialTimeout: jsonDuration(c.DialTimeout),
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	c.IdleTimeout = time.Duration(v.IdleTimeout)
+	c.MaxLife = time.Duration(v.MaxLife)
+	c.DialTimeout = time.Duration(v.DialTimeout)
+	return nil
+}
+
+// jsonDuration is a duration decoded from a string such as "30s" or from
+// integer nanoseconds
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || data[0] != '"' {
+		// The integer nanoseconds, as time.Duration decodes them
+		return json.Unmarshal(data, (*time.Duration)(d))
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+// Validate returns an error wrapping ErrInvalidConfig if the settings are out
+// of bounds. Unlike the options, a Config doesn't default its zero values: a
+// capacity of 0 is invalid
+func (c Config) Validate() error {
+	switch {
+	case c.Capacity <= 0:
+		return fmt.Errorf("%w: capacity %d isn't positive", ErrInvalidConfig, c.Capacity)
+	case c.InitialConns < 0 || c.InitialConns > c.Capacity:
+		return fmt.Errorf("%w: %d initial connections aren't between 0 and the capacity of %d",
+			ErrInvalidConfig, c.InitialConns, c.Capacity)
+	case c.IdleTimeout < 0:
+		return fmt.Errorf("%w: negative idle timeout %s", ErrInvalidConfig, c.IdleTimeout)
+	case c.MaxLife < 0:
+		return fmt.Errorf("%w: negative max life %s", ErrInvalidConfig, c.MaxLife)
+	case c.DialTimeout < 0:
+		return fmt.Errorf("%w: negative dial timeout %s", ErrInvalidConfig, c.DialTimeout)
+	}
+	return nil
+}
+
+// Options returns the options applying the settings
+func (c Config) Options() []Option {
+	opts := []Option{
+		WithCapacity(c.Capacity),
+		WithInitialConns(c.InitialConns),
+		WithIdleTimeout(c.IdleTimeout),
+		WithMaxLife(c.MaxLife),
+		WithDialTimeout(c.DialTimeout),
+	}
+	if c.Name != "" {
+		opts = append(opts, WithName(c.Name))
+	}
+	return opts
+}
+
+// NewFromConfig validates cfg and creates a pool with its settings, followed
+// by opts for the settings Config doesn't cover. Returns an error if cfg is
+// invalid or the initial clients could not be created.
+func NewFromConfig(ctx context.Context, factory FactoryWithContext, cfg Config, opts ...Option) (*Pool, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return NewWithOptions(ctx, factory, append(cfg.Options(), opts...)...)
+}
+
+// Apply updates the idle timeout, the max life duration, the dial timeout
+// and the capacity of the pool with the ones of cfg, for instance when
+// reloading a configuration file. The idle timeout and the max life change
+// like with SetIdleTimeout and SetMaxLifeDuration, the dial timeout applies
+// to the clients created afterward. The capacity changes like with Resize,
+// without waiting, and is left unchanged if it's 0 or the pool is unlimited.
+// The initial clients and the name only apply when creating a pool, so
+// unlike Validate, Apply only rejects the settings it uses that are out of
+// bounds
+func (p *Pool) Apply(cfg Config) error {
+	switch {
+	case cfg.Capacity < 0:
+		return fmt.Errorf("%w: negative capacity %d", ErrInvalidConfig, cfg.Capacity)
+	case cfg.IdleTimeout < 0:
+		return fmt.Errorf("%w: negative idle timeout %s", ErrInvalidConfig, cfg.IdleTimeout)
+	case cfg.MaxLife < 0:
+		return fmt.Errorf("%w: negative max life %s", ErrInvalidConfig, cfg.MaxLife)
+	case cfg.DialTimeout < 0:
+		return fmt.Errorf("%w: negative dial timeout %s", ErrInvalidConfig, cfg.DialTimeout)
+	}
+
+	p.mu.Lock()
+	p.idleTimeout = cfg.IdleTimeout
+	p.maxLifeDuration = cfg.MaxLife
+	p.dialTimeout = cfg.DialTimeout
+	capacity := p.capacity
+	p.mu.Unlock()
+
+	if p.unlimited || cfg.Capacity == 0 || cfg.Capacity == capacity {
+		return nil
+	}
+	_, err := p.resize(cfg.Capacity)
+	return err
+}
+
+// Clone creates a new pool with the same factory and options as the pool,
+// for instance for a blue/green swap. The settings changed since the pool
+// was created, such as with SetFactory, Apply or Resize, carry over. The new
+// pool creates its own connections, ctx being passed to the factory like
+// with NewWithOptions
+func (p *Pool) Clone(ctx context.Context) (*Pool, error) {
+	idleTimeout, maxLife, dialTimeout := p.timeouts()
+	p.mu.RLock()
+	factory, factorySet, capacity := p.factory, p.factorySet, p.capacity
+	p.mu.RUnlock()
+
+	opts := append(p.opts[:len(p.opts):len(p.opts)],
+		WithIdleTimeout(idleTimeout),
+		WithMaxLife(maxLife),
+		WithDialTimeout(dialTimeout),
+	)
+	if !p.unlimited {
+		opts = append(opts, WithCapacity(capacity))
+	}
+	if factorySet {
+		// The factory replaced the one of the options, such as WithTiers
+		opts = append(opts, WithFactory(factory))
+	}
+	return NewWithOptions(ctx, factory, opts...)
+}
+
+// timeouts returns the idle timeout, the max life duration and the dial
+// timeout of the pool, which Apply may change at any time
+func (p *Pool) timeouts() (idleTimeout, maxLife, dialTimeout time.Duration) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.idleTimeout, p.maxLifeDuration, p.dialTimeout
+}
+
+// PoolConfig is the effective configuration of a pool, as set by its options
+// once the defaults and bounds were applied. It covers every option taking
+// plain values: the factory, the hooks and the other functions and
+// connections passed to the options, such as WithTiers, WithFallback or
+// WithConnSelector, aren't part of it
+type PoolConfig struct {
+	// Name is the WithName name of the pool, if any
+	Name string
+	// Capacity is the maximum number of clients, -1 if the pool is unlimited
+	Capacity int
+	// Unlimited is true if the pool has no capacity, see WithUnlimited
+	Unlimited bool
+	// ElasticCapacity is true if the pool only allocates memory for its
+	// idle clients, as with WithElasticCapacity or WithBurst
+	ElasticCapacity bool
+	// BurstSoftCap and BurstTTL are the WithBurst settings, a soft capacity
+	// of 0 meaning there is no burst capacity
+	BurstSoftCap int
+	BurstTTL     time.Duration
+	// MaxIdle is the maximum number of idle clients, 0 if unbounded
+	MaxIdle int
+	// MaxLifetimeConnections is the number of connections the factory may
+	// create over the lifetime of the pool, 0 if unbounded
+	MaxLifetimeConnections int
+	// InitialConns is the number of clients created with the pool
+	InitialConns int
+	// IdleTimeout is the duration after which an idle client is recycled,
+	// 0 if disabled
+	IdleTimeout time.Duration
+	// MaxLifeDuration is the duration after which a client is recycled, 0
+	// if disabled
+	MaxLifeDuration time.Duration
+	// MaxLifeJitter is the fraction of MaxLifeDuration by which the max life
+	// of each client is spread
+	MaxLifeJitter float64
+	// MaxRequestsPerConn is the number of checkouts after which a client is
+	// recycled, 0 if disabled
+	MaxRequestsPerConn int
+	// ReadyTimeout is the WithWaitForReady timeout, 0 if Get doesn't wait
+	// for the clients to be ready
+	ReadyTimeout time.Duration
+	// RecycleNotReady is true if Get recycles the clients that didn't become
+	// ready in time
+	RecycleNotReady bool
+	// CheckoutOrder is the order in which Get hands out the idle clients
+	CheckoutOrder CheckoutOrder
+	// RecycleOnGoAway is true if Get recycles the clients drained by a GOAWAY
+	RecycleOnGoAway bool
+	// ReapInterval is the interval of the background recycling of the idle
+	// clients, 0 if disabled
+	ReapInterval time.Duration
+	// DialConcurrency is the maximum number of factory calls in flight, 0 if
+	// unbounded
+	DialConcurrency int
+	// DialTimeout bounds each factory call, 0 if it's unbounded
+	DialTimeout time.Duration
+	// GetTimeout bounds the wait for a client, 0 if only the context of Get
+	// bounds it
+	GetTimeout time.Duration
+	// BreakerThreshold and BreakerCooldown are the circuit breaker settings,
+	// a threshold of 0 meaning there is no circuit breaker
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// MinInitialConns is the number of initial clients that had to succeed
+	// for the pool to be created, -1 if any failure was fatal
+	MinInitialConns int
+	// InitRetryMin and InitRetryMax are the WithInitRetry backoffs, 0 if the
+	// failed initial clients aren't retried
+	InitRetryMin time.Duration
+	InitRetryMax time.Duration
+	// BackgroundWarmup is true if the initial clients are created in the
+	// background
+	BackgroundWarmup bool
+	// EagerConnectTimeout is the WithEagerConnect timeout, 0 if the clients
+	// only connect on their first RPC
+	EagerConnectTimeout time.Duration
+	// ReturnToFront is true if Close puts the clients given back where
+	// they're the next to be handed out
+	ReturnToFront bool
+	// FailFastWhenUnhealthy is true if Get fails right away when every
+	// client is unhealthy
+	FailFastWhenUnhealthy bool
+	// PauseBehavior is what Get does while the pool is paused
+	PauseBehavior PauseBehavior
+	// Partitions are the WithPartitions limits, 0 for an unbounded partition
+	Partitions map[string]int
+	// StrictConfig is true if out of bounds options fail the pool creation
+	StrictConfig bool
+}
+
+// Config returns the configuration of the pool. It's still available once
+// the pool is closed
+func (p *Pool) Config() PoolConfig {
+	idleTimeout, maxLife, dialTimeout := p.timeouts()
+	p.mu.RLock()
+	capacity := p.capacity
+	p.mu.RUnlock()
+	c := PoolConfig{
+		Name:                   p.name,
+		Capacity:               capacity,
+		InitialConns:           p.init,
+		IdleTimeout:            idleTimeout,
+		MaxLifeDuration:        maxLife,
+		MaxLifeJitter:          p.maxLifeJitter,
+		ReadyTimeout:           p.readyTimeout,
+		MaxRequestsPerConn:     p.maxRequests,
+		RecycleNotReady:        p.recycleNotReady,
+		CheckoutOrder:          p.order,
+		RecycleOnGoAway:        p.recycleGoAway,
+		ReapInterval:           p.reapInterval,
+		DialConcurrency:        cap(p.dialSem),
+		DialTimeout:            dialTimeout,
+		GetTimeout:             p.getTimeout,
+		MinInitialConns:        -1,
+		Unlimited:              p.unlimited,
+		ElasticCapacity:        p.elastic,
+		BurstSoftCap:           p.burstSoft,
+		BurstTTL:               p.burstTTL,
+		MaxIdle:                p.maxIdle,
+		MaxLifetimeConnections: int(p.maxCreated),
+		InitRetryMin:           p.initRetryMin,
+		InitRetryMax:           p.initRetryMax,
+		BackgroundWarmup:       p.warmup,
+		EagerConnectTimeout:    p.eagerTimeout,
+		ReturnToFront:          p.returnToFront,
+		FailFastWhenUnhealthy:  p.failFast,
+		PauseBehavior:          p.pauseBehavior,
+		StrictConfig:           p.strict,
+	}
+	if p.partitions != nil {
+		c.Partitions = make(map[string]int, len(p.partitions))
+		for name, sem := range p.partitions {
+			c.Partitions[name] = cap(sem)
+		}
+	}
+	if p.breaker != nil {
+		c.BreakerThreshold = p.breaker.threshold
+		c.BreakerCooldown = p.breaker.cooldown
+	}
+	if p.tolerateInit {
+		c.MinInitialConns = p.minInit
+	}
+	return c
+}
+
+// validate returns an error wrapping ErrInvalidConfig for the first setting
+// the pool would otherwise clamp, for WithStrictConfig
+func (p *Pool) validate() error {
+	// The capacity defaults to 1 when it isn't set at all
+	capacity := p.capacity
+	if !p.capacitySet {
+		capacity = 1
+	}
+	switch {
+	case !p.unlimited && capacity <= 0:
+		return fmt.Errorf("%w: capacity %d isn't positive", ErrInvalidConfig, capacity)
+	case p.init < 0:
+		return fmt.Errorf("%w: %d initial connections", ErrInvalidConfig, p.init)
+	case !p.unlimited && p.init > capacity:
+		return fmt.Errorf("%w: %d initial connections exceed the capacity of %d",
+			ErrInvalidConfig, p.init, capacity)
+	case p.maxLifeJitter < 0 || p.maxLifeJitter > 1:
+		return fmt.Errorf("%w: max life jitter %v isn't between 0 and 1", ErrInvalidConfig, p.maxLifeJitter)
+	case p.burstSoft < 0 || (!p.unlimited && p.burstSoft > capacity):
+		return fmt.Errorf("%w: burst soft capacity %d isn't between 0 and the capacity of %d",
+			ErrInvalidConfig, p.burstSoft, capacity)
+	}
+	return nil
+}
+
+// NewForTarget is like NewFromConfig, with a factory dialing target with
+// dialOpts. The factory appends the dial options of GetDedicated and
+// WithDialOverride to dialOpts.
+func NewForTarget(ctx context.Context, target string, dialOpts []grpc.DialOption, cfg Config,
+	opts ...Option) (*Pool, error) {
+
+	factory := func(ctx context.Context) (*grpc.ClientConn, error) {
+		// Capping the options makes append copy them rather than write
+		// into the backing array of the caller
+		extra := DialOptionsFromContext(ctx)
+		extra = append(extra[:len(extra):len(extra)], DialOverrideFromContext(ctx)...)
+		return grpc.NewClient(target, append(dialOpts[:len(dialOpts):len(dialOpts)], extra...)...)
+	}
+	return NewFromConfig(ctx, factory, cfg, opts...)
+}
@@ -0,0 +1,81 @@
+package grpcpool
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// dialOptionsKey is the context key of the dial options of GetDedicated
+type dialOptionsKey struct{}
+
+// DialOptionsFromContext returns the dial options passed to GetDedicated, if
+// the factory is called on its behalf. A factory supporting GetDedicated
+// appends them to its own options.
+func DialOptionsFromContext(ctx context.Context) []grpc.DialOption {
+	opts, _ := ctx.Value(dialOptionsKey{}).([]grpc.DialOption)
+	return opts
+}
+
+// dialOverrideKey is the context key of the dial options of WithDialOverride
+type dialOverrideKey struct{}
+
+// WithDialOverride returns a copy of ctx carrying dialOpts for the factory: if
+// Get is called with it and creates a new connection, the factory gets them
+// through DialOverrideFromContext. The connection is then pooled like any
+// other and may be handed out to other callers later, the overrides must not
+// make it unfit for them.
+func WithDialOverride(ctx context.Context, dialOpts ...grpc.DialOption) context.Context {
+	// Capping the parent options makes append copy them rather than share
+	// their backing array
+	opts := DialOverrideFromContext(ctx)
+	opts = append(opts[:len(opts):len(opts)], dialOpts...)
+	return context.WithValue(ctx, dialOverrideKey{}, opts)
+}
+
+// DialOverrideFromContext returns the dial options added to the context of Get
+// with WithDialOverride. A factory supporting them appends them to its own
+// options.
+func DialOverrideFromContext(ctx context.Context) []grpc.DialOption {
+	opts, _ := ctx.Value(dialOverrideKey{}).([]grpc.DialOption)
+	return opts
+}
+
+// GetDedicated creates a connection with the factory for the caller alone,
+// for the RPCs that can't share a pooled connection. dialOpts are made
+// available to the factory through DialOptionsFromContext. The connection
+// doesn't count against the capacity of the pool and isn't given back to it:
+// Close closes it. It returns an error wrapping ErrTimeout if ctx is done
+// while waiting for a WithDialConcurrency slot.
+func (p *Pool) GetDedicated(ctx context.Context, dialOpts ...grpc.DialOption) (c *ClientConn, err error) {
+	defer func() {
+		err = p.named(err)
+	}()
+
+	if p.initClients() == nil {
+		return nil, ErrClosed
+	}
+	if !p.acquireDial(ctx) {
+		return nil, fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+	}
+	defer p.releaseDial()
+
+	if len(dialOpts) > 0 {
+		ctx = context.WithValue(ctx, dialOptionsKey{}, dialOpts)
+	}
+	cc, latency, err := p.dial(p.factoryContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	now := p.clock.Now()
+	return &ClientConn{
+		ClientConn:    cc,
+		pool:          p,
+		timeUsed:      now,
+		timeInitiated: now,
+		dialLatency:   latency,
+		fresh:         true,
+		dedicated:     true,
+	}, nil
+}
@@ -0,0 +1,114 @@
+package grpcpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestGetDedicated(t *testing.T) {
+	var dialOpts int
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		opts := append([]grpc.DialOption{grpc.WithInsecure()}, DialOptionsFromContext(ctx)...)
+		dialOpts = len(opts)
+		return grpc.Dial("example.com", opts...)
+	}, WithCapacity(1))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	events := p.Events()
+	c, err := p.GetDedicated(context.Background(), grpc.WithUserAgent("dedicated"))
+	if err != nil {
+		t.Errorf("GetDedicated returned an error: %s", err.Error())
+	}
+	if dialOpts != 2 {
+		t.Errorf("The factory got %d dial options but should have got 2", dialOpts)
+	}
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+	if n := len(p.Inspect()); n != 0 {
+		t.Errorf("The pool held %d connections but should hold 0", n)
+	}
+
+	cc := c.ClientConn
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+	if cc.GetState() != connectivity.Shutdown {
+		t.Errorf("Close should have closed the dedicated connection")
+	}
+	for _, kind := range []EventKind{ConnCreated, ConnClosed} {
+		if e := <-events; e.Kind != kind {
+			t.Errorf("The event was %s but should be %s", e.Kind, kind)
+		}
+	}
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+
+	p.Close()
+	if _, err := p.GetDedicated(context.Background()); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+}
+
+func TestWithDialOverride(t *testing.T) {
+	var overrides int
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		overrides = len(DialOverrideFromContext(ctx))
+		opts := append([]grpc.DialOption{grpc.WithInsecure()}, DialOverrideFromContext(ctx)...)
+		return grpc.Dial("example.com", opts...)
+	}, WithCapacity(1))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	ctx := WithDialOverride(context.Background(), grpc.WithUserAgent("bulk"))
+	ctx = WithDialOverride(ctx, grpc.WithAuthority("example.org"))
+	c, err := p.Get(ctx)
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	defer c.Close()
+	if overrides != 2 {
+		t.Errorf("The factory got %d dial overrides but should have got 2", overrides)
+	}
+}
+
+func TestGetDedicatedDialConcurrency(t *testing.T) {
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		started <- struct{}{}
+		<-block
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithDialConcurrency(1))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	done := make(chan *ClientConn, 1)
+	go func() {
+		c, _ := p.GetDedicated(context.Background())
+		done <- c
+	}()
+	<-started
+
+	// The only dial slot is taken
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.GetDedicated(ctx)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+	close(block)
+	(<-done).Close()
+}
@@ -0,0 +1,21 @@
+package grpcpool
+
+import "context"
+
+// GetContext is like Get, but also returns the context to use for the RPCs
+// made with the client: ctx as enriched for this client by the
+// WithContextEnricher function, or ctx itself without one.
+func (p *Pool) GetContext(ctx context.Context) (*ClientConn, context.Context, error) {
+	c, err := p.Get(ctx)
+	if err != nil || p.enricher == nil {
+		return c, ctx, err
+	}
+	var rpcCtx context.Context
+	p.safeCall("ContextEnricher", func() {
+		rpcCtx = p.enricher(ctx, c)
+	})
+	if rpcCtx != nil {
+		return c, rpcCtx, nil
+	}
+	return c, ctx, nil
+}
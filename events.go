@@ -0,0 +1,87 @@
+package grpcpool
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventKind is the kind of an Event
+type EventKind int
+
+const (
+	// ConnCreated is sent when the factory created a connection
+	ConnCreated EventKind = iota
+	// ConnClosed is sent when the pool closed a connection
+	ConnClosed
+	// ConnUnhealthy is sent when a checked out connection is marked as
+	// unhealthy
+	ConnUnhealthy
+	// GetBlocked is sent when Get has to wait for a client
+	GetBlocked
+	// GetServed is sent when Get hands out a client
+	GetServed
+	// PoolClosed is sent when the pool is closed
+	PoolClosed
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case ConnCreated:
+		return "ConnCreated"
+	case ConnClosed:
+		return "ConnClosed"
+	case ConnUnhealthy:
+		return "ConnUnhealthy"
+	case GetBlocked:
+		return "GetBlocked"
+	case GetServed:
+		return "GetServed"
+	case PoolClosed:
+		return "PoolClosed"
+	}
+	return "Unknown"
+}
+
+// Event is a lifecycle transition of a pool, see Events
+type Event struct {
+	Kind EventKind
+	// Time is when the event happened
+	Time time.Time
+	// Target is the target of the connection of the Conn events and of
+	// GetServed
+	Target string
+	// Age is the age of the connection of ConnClosed
+	Age time.Duration
+	// Reason is why the connection of ConnClosed was closed, such as "idle"
+	// or "max life", "dedicated" for a GetDedicated connection being closed
+	Reason string
+	// Waited is the time GetServed waited for a client
+	Waited time.Duration
+}
+
+// eventsBuffer is the number of events buffered for a slow consumer
+const eventsBuffer = 256
+
+// Events returns a channel receiving the lifecycle events of the pool, from
+// the first call to Events on. The channel buffers up to 256 events: the
+// events sent while it's full are dropped rather than blocking the pool, and
+// counted in Stats.DroppedEvents. It's never closed, the connections checked
+// out when the pool is closed sending their ConnClosed events afterward.
+func (p *Pool) Events() <-chan Event {
+	atomic.StoreInt32(&p.eventsOn, 1)
+	return p.events
+}
+
+// emit sends an event if Events was called, dropping it if the channel is
+// full
+func (p *Pool) emit(e Event) {
+	if atomic.LoadInt32(&p.eventsOn) == 0 {
+		return
+	}
+	e.Time = p.clock.Now()
+	select {
+	case p.events <- e:
+	default:
+		atomic.AddInt64(&p.droppedEvents, 1)
+	}
+}
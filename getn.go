@@ -0,0 +1,59 @@
+package grpcpool
+
+import "context"
+
+// GetN checks out n distinct clients at once, for a fan-out that needs its
+// full degree. It's all or nothing: if ctx is done or getting a client fails
+// before all n were acquired, the acquired clients are given back to the
+// pool and the error is returned. It returns ErrTooManyClients if n exceeds
+// the capacity, as it could never succeed.
+//
+// Two callers each holding part of the clients while waiting for the rest
+// would deadlock until their contexts expire. GetN avoids it by letting a
+// single batch acquire clients at a time, the others waiting for their turn,
+// so that a batch only ever waits for clients held by regular callers. Such
+// callers holding clients while waiting for a batch can still deadlock with
+// it, hence ctx should always carry a deadline.
+func (p *Pool) GetN(ctx context.Context, n int) (_ []*ClientConn, err error) {
+	defer func() {
+		err = p.named(err)
+	}()
+
+	if n <= 0 {
+		return nil, nil
+	}
+	clients := p.initClients()
+	if clients == nil {
+		return nil, ErrClosed
+	}
+	if capacity := clients.cap(); capacity >= 0 && n > capacity {
+		return nil, ErrTooManyClients
+	}
+
+	wait, stop := p.getWait()
+	defer stop()
+	select {
+	case p.batch <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	case <-wait:
+		return nil, ErrTimeout
+	}
+	defer func() { <-p.batch }()
+
+	conns := make([]*ClientConn, 0, n)
+	for len(conns) < n {
+		c, err := p.get(ctx, wait, false)
+		if err != nil {
+			if c != nil {
+				c.Close()
+			}
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+	return conns, nil
+}
@@ -0,0 +1,36 @@
+package grpcpool
+
+// safeCall calls the user supplied hook fn, recovering from its panic so that
+// a buggy hook can't leave the pool in an inconsistent state. The panic is
+// reported to the WithOnHookPanic callback, if any, along with the name of the
+// hook. It returns false if fn panicked
+func (p *Pool) safeCall(hook string, fn func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+			p.hookPanicked(hook, r)
+		}
+	}()
+	fn()
+	return true
+}
+
+// hookPanicked reports a panic of hook, ignoring a panic of the callback
+// itself
+func (p *Pool) hookPanicked(hook string, r interface{}) {
+	if p.onHookPanic == nil {
+		return
+	}
+	defer func() {
+		recover()
+	}()
+	p.onHookPanic(hook, r)
+}
+
+// selectorPanicked reports a panic of the WithConnSelector function, which
+// the queue recovers from by falling back to the checkout order. It's called
+// once the queue is unlocked, so that the WithOnHookPanic callback can use
+// the pool
+func (p *Pool) selectorPanicked(recovered interface{}) {
+	p.hookPanicked("selector", recovered)
+}
@@ -0,0 +1,91 @@
+package grpcpool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestHookPanic(t *testing.T) {
+	var panicked []string
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(2),
+		WithOnGet(func(c *ClientConn, waited time.Duration) {
+			panic("get")
+		}),
+		WithOnPut(func(c *ClientConn) {
+			panic("put")
+		}),
+		WithConnSelector(func(candidates []*ClientConn) int {
+			panic("selector")
+		}),
+		WithOnHookPanic(func(hook string, recovered interface{}) {
+			panicked = append(panicked, hook)
+		}))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("Close returned an error: %s", err.Error())
+		}
+	}
+	if a := p.Available(); a != 2 {
+		t.Errorf("The pool available was %d but should be 2", a)
+	}
+	if n := p.InUse(); n != 0 {
+		t.Errorf("The pool in use was %d but should be 0", n)
+	}
+	if len(panicked) != 6 {
+		t.Errorf("The hooks panicked %d times but should have panicked 6 times: %v", len(panicked), panicked)
+	}
+}
+
+func TestSelectorPanicUsingPool(t *testing.T) {
+	var p *Pool
+	panicked := 0
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(2), WithInitialConns(2),
+		WithConnSelector(func(candidates []*ClientConn) int {
+			panic("selector")
+		}),
+		WithOnHookPanic(func(hook string, recovered interface{}) {
+			// The queue must not be locked anymore
+			p.Stats()
+			panicked++
+		}))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := p.Get(context.Background())
+		if err == nil {
+			err = c.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get deadlocked reporting the selector panic")
+	}
+	if panicked != 1 {
+		t.Errorf("The selector panicked %d times but should have panicked once", panicked)
+	}
+}
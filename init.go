@@ -0,0 +1,37 @@
+package grpcpool
+
+import "context"
+
+// Init sets up a zero-value Pool with the given options, which must provide
+// a factory unless SetFactory was called before. It's an alternative to
+// NewWithOptions for the pools embedded in other structs, and can only be
+// called once: it returns ErrInitialized if the pool was already initialized,
+// created with a constructor, or closed. A pool whose Init failed stays
+// closed.
+//
+// Get on a zero-value Pool, like the other methods checking out clients and
+// Put, initializes it with the default options if a factory was set with
+// SetFactory, and returns ErrClosed otherwise.
+func (p *Pool) Init(opts ...Option) error {
+	return p.initialize(context.Background(), opts)
+}
+
+// initClients returns the clients of the pool, initializing a zero-value pool
+// with lazyInit first
+func (p *Pool) initClients() *connQueue {
+	if clients := p.getClients(); clients != nil {
+		return clients
+	}
+	return p.lazyInit()
+}
+
+// lazyInit initializes a zero-value pool from the factory set with
+// SetFactory, for Get. It returns the clients of the pool, nil if there is no
+// factory or the pool was already initialized and has been closed since.
+func (p *Pool) lazyInit() *connQueue {
+	if p.getFactory() == nil {
+		return nil
+	}
+	p.initialize(context.Background(), nil)
+	return p.getClients()
+}
@@ -0,0 +1,100 @@
+package grpcpool
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// execAttempts is the number of clients Exec tries call with
+const execAttempts = 3
+
+// Invoke gets a client from the pool, runs call with its connection and
+// gives the client back, even if call panics. It returns the error of Get or
+// the one of call.
+func (p *Pool) Invoke(ctx context.Context, call func(cc *grpc.ClientConn) error) error {
+	c, err := p.Get(ctx)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	defer c.Close()
+
+	return call(c.ClientConn)
+}
+
+// Exec is like Invoke, but retries call on another client when it fails with
+// a transient error: codes.Unavailable, which grpc returns for the transport
+// failures, or codes.Canceled while ctx is still live, as when the connection
+// got closed. The client of the failed call is marked as unhealthy so that
+// it's recycled. call is tried at most 3 times and not retried once ctx is
+// done, the last error being returned.
+func (p *Pool) Exec(ctx context.Context, call func(cc *grpc.ClientConn) error) error {
+	var err error
+	for i := 0; i < execAttempts; i++ {
+		var retry bool
+		if retry, err = p.exec(ctx, call); !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// exec runs call once for Exec, returning true if it's worth retrying
+func (p *Pool) exec(ctx context.Context, call func(cc *grpc.ClientConn) error) (bool, error) {
+	c, err := p.Get(ctx)
+	if err != nil {
+		c.Close()
+		return false, err
+	}
+	defer c.Close()
+
+	err = call(c.ClientConn)
+	if !isTransient(ctx, err) {
+		return false, err
+	}
+	c.Unhealthy()
+	return ctx.Err() == nil, err
+}
+
+// isTransient returns true if err is worth retrying on another connection
+func isTransient(ctx context.Context, err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return true
+	case codes.Canceled:
+		return ctx.Err() == nil
+	}
+	return false
+}
+
+// NewStream gets a client from the pool and opens a stream on its connection.
+// The client stays checked out, and so out of reach of the idle and max life
+// recycling, until the returned cleanup function is called, which must be
+// done once the stream is over. Calling cleanup more than once is a no-op. If
+// Get or opening the stream fails, the client is given back right away and
+// the error returned.
+func (p *Pool) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string,
+	opts ...grpc.CallOption) (grpc.ClientStream, func(), error) {
+
+	c, err := p.Get(ctx)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	stream, err := c.ClientConn.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	return stream, func() {
+		once.Do(func() {
+			c.Close()
+		})
+	}, nil
+}
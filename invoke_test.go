@@ -0,0 +1,143 @@
+package grpcpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInvoke(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	callErr := errors.New("call error")
+	err = p.Invoke(context.Background(), func(cc *grpc.ClientConn) error {
+		if a := p.Available(); a != 0 {
+			t.Errorf("The pool available was %d but should be 0", a)
+		}
+		return callErr
+	})
+	if err != callErr {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", callErr, err)
+	}
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+
+	// The client is given back even if the call panics
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Invoke should have propagated the panic")
+			}
+		}()
+		p.Invoke(context.Background(), func(cc *grpc.ClientConn) error {
+			panic("call panic")
+		})
+	}()
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+
+	p.Close()
+	err = p.Invoke(context.Background(), func(cc *grpc.ClientConn) error {
+		t.Errorf("The call shouldn't run on a closed pool")
+		return nil
+	})
+	if err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+}
+
+func TestNewStream(t *testing.T) {
+	addr := newTestServer(t)
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial(addr, grpc.WithInsecure())
+	}, 1, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, cleanup, err := p.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/test.Service/Watch")
+	if err != nil {
+		t.Fatalf("NewStream returned an error: %s", err.Error())
+	}
+	if stream == nil {
+		t.Error("stream was nil")
+	}
+	if a := p.Available(); a != 0 {
+		t.Errorf("The pool available was %d but should be 0", a)
+	}
+
+	cleanup()
+	cleanup()
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+}
+
+func TestExec(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(2), WithInitialConns(2))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	// A transient failure is retried on another connection, the failed one
+	// being recycled
+	var conns []*grpc.ClientConn
+	err = p.Exec(context.Background(), func(cc *grpc.ClientConn) error {
+		conns = append(conns, cc)
+		if len(conns) == 1 {
+			return status.Error(codes.Unavailable, "connection refused")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Exec returned an error: %s", err.Error())
+	}
+	if len(conns) != 2 || conns[0] == conns[1] {
+		t.Errorf("Exec should have retried once on another connection")
+	}
+	if r := p.Stats().RecycledUnhealthy; r != 1 {
+		t.Errorf("The pool recycled %d unhealthy clients but should recycle 1", r)
+	}
+
+	// It gives up after 3 attempts
+	calls := 0
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	err = p.Exec(context.Background(), func(cc *grpc.ClientConn) error {
+		calls++
+		return unavailable
+	})
+	if err != unavailable || calls != 3 {
+		t.Errorf("Exec returned \"%v\" after %d calls but should fail after 3", err, calls)
+	}
+
+	// The other errors aren't retried
+	calls = 0
+	notFound := status.Error(codes.NotFound, "not found")
+	err = p.Exec(context.Background(), func(cc *grpc.ClientConn) error {
+		calls++
+		return notFound
+	})
+	if err != notFound || calls != 1 {
+		t.Errorf("Exec returned \"%v\" after %d calls but should fail after 1", err, calls)
+	}
+	if a := p.Available(); a != 2 {
+		t.Errorf("The pool available was %d but should be 2", a)
+	}
+}
@@ -0,0 +1,233 @@
+package grpcpool
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PoolManager lazily creates and caches a pool per target, for processes
+// talking to many distinct services
+type PoolManager struct {
+	factoryFor func(target string) FactoryWithContext
+	opts       []Option
+	limits     ManagerLimits
+	clock      clock
+
+	mu     sync.Mutex
+	pools  map[string]*managedPool
+	closed bool
+}
+
+// ManagerLimits bounds the pools cached by a PoolManager, for gateways
+// talking to many dynamic backends. The zero value doesn't bound them
+type ManagerLimits struct {
+	// TTL is the time after which the pool of a target nobody asked for is
+	// closed and forgotten, 0 to keep it
+	TTL time.Duration
+	// MaxEntries is the maximum number of pools, the least recently used one
+	// being closed and forgotten to make room for a new target. 0 doesn't
+	// bound them
+	MaxEntries int
+}
+
+// managedPool is a pool of the manager, ready is closed once it's created
+type managedPool struct {
+	ready chan struct{}
+	pool  *Pool
+	err   error
+	// lastUsed is when the pool was last asked for, guarded by the lock of
+	// the manager
+	lastUsed time.Time
+}
+
+// NewManager creates a pool manager. The pool of a target is created the
+// first time it's requested, using the factory returned by factoryFor and
+// the default options
+func NewManager(factoryFor func(target string) FactoryWithContext,
+	defaultOpts ...Option) *PoolManager {
+
+	return NewManagerWithLimits(factoryFor, ManagerLimits{}, defaultOpts...)
+}
+
+// NewManagerWithLimits is like NewManager, but bounds the cached pools with
+// limits. The pools are only evicted when a pool is requested, a pool being
+// closed once evicted: its checked out clients are closed when they're given
+// back
+func NewManagerWithLimits(factoryFor func(target string) FactoryWithContext, limits ManagerLimits,
+	defaultOpts ...Option) *PoolManager {
+
+	return &PoolManager{
+		factoryFor: factoryFor,
+		opts:       defaultOpts,
+		limits:     limits,
+		clock:      realClock{},
+		pools:      make(map[string]*managedPool),
+	}
+}
+
+// Get returns a client of the pool of target, creating the pool if needed.
+// Concurrent calls for a new target wait for a single pool to be created. If
+// the creation fails, the error is returned and the next call retries.
+func (m *PoolManager) Get(ctx context.Context, target string) (*ClientConn, error) {
+	p, err := m.pool(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return p.Get(ctx)
+}
+
+// pool returns the pool of target, creating it if needed
+func (m *PoolManager) pool(ctx context.Context, target string) (*Pool, error) {
+	now := m.clock.Now()
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	evicted := m.evictExpired(now, target)
+	mp, ok := m.pools[target]
+	if !ok {
+		if max := m.limits.MaxEntries; max > 0 && len(m.pools) >= max {
+			if lru := m.evictLRU(); lru != nil {
+				evicted = append(evicted, lru)
+			}
+		}
+		mp = &managedPool{
+			ready: make(chan struct{}),
+		}
+		m.pools[target] = mp
+	}
+	mp.lastUsed = now
+	m.mu.Unlock()
+
+	for _, p := range evicted {
+		p.Close()
+	}
+
+	if ok {
+		select {
+		case <-mp.ready:
+			return mp.pool, mp.err
+		case <-ctx.Done():
+			return nil, ErrTimeout
+		}
+	}
+
+	mp.pool, mp.err = NewWithOptions(ctx, m.factoryFor(target), m.opts...)
+	m.mu.Lock()
+	if mp.err != nil {
+		delete(m.pools, target)
+	} else if m.closed {
+		// The manager was closed while we created the pool
+		mp.pool.Close()
+		mp.pool, mp.err = nil, ErrClosed
+	}
+	m.mu.Unlock()
+	close(mp.ready)
+
+	return mp.pool, mp.err
+}
+
+// evictExpired forgets the pools unused for longer than the TTL, but the one
+// of target, and returns them to be closed. The lock must be held
+func (m *PoolManager) evictExpired(now time.Time, target string) []*Pool {
+	if m.limits.TTL <= 0 {
+		return nil
+	}
+	var evicted []*Pool
+	for t, mp := range m.pools {
+		if t == target || !mp.created() || !mp.lastUsed.Add(m.limits.TTL).Before(now) {
+			continue
+		}
+		delete(m.pools, t)
+		if mp.pool != nil {
+			evicted = append(evicted, mp.pool)
+		}
+	}
+	return evicted
+}
+
+// evictLRU forgets the least recently used pool among the created ones and
+// returns it to be closed, nil if there is none. The lock must be held
+func (m *PoolManager) evictLRU() *Pool {
+	var lru string
+	var oldest *managedPool
+	for t, mp := range m.pools {
+		if mp.created() && (oldest == nil || mp.lastUsed.Before(oldest.lastUsed)) {
+			lru, oldest = t, mp
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	delete(m.pools, lru)
+	return oldest.pool
+}
+
+// created returns true once the creation of the pool is over, whether it
+// succeeded or not
+func (mp *managedPool) created() bool {
+	select {
+	case <-mp.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseAll closes all the pools of the manager. Get isn't allowed anymore
+// afterward
+func (m *PoolManager) CloseAll() {
+	m.closeAll()
+}
+
+// closeAll closes all the pools of the manager, returning the ones that were
+// created
+func (m *PoolManager) closeAll() []*Pool {
+	m.mu.Lock()
+	m.closed = true
+	pools := m.pools
+	m.pools = make(map[string]*managedPool)
+	m.mu.Unlock()
+
+	closed := make([]*Pool, 0, len(pools))
+	for _, mp := range pools {
+		<-mp.ready
+		if mp.pool != nil {
+			mp.pool.Close()
+			closed = append(closed, mp.pool)
+		}
+	}
+	return closed
+}
+
+// Drain closes all the pools of the manager like CloseAll, then waits for
+// the connections that were checked out to be given back and closed. It
+// returns ctx.Err() if ctx is done first, the pools being closed anyway.
+func (m *PoolManager) Drain(ctx context.Context) error {
+	for _, p := range m.closeAll() {
+		if err := p.WaitClosed(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the stats of all the pools of the manager, by target
+func (m *PoolManager) Stats() map[string]Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make(map[string]Stats, len(m.pools))
+	for target, mp := range m.pools {
+		select {
+		case <-mp.ready:
+			if mp.pool != nil {
+				stats[target] = mp.pool.Stats()
+			}
+		default:
+		}
+	}
+	return stats
+}
@@ -0,0 +1,138 @@
+package grpcpool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestPoolManager(t *testing.T) {
+	var created int32
+	m := NewManager(func(target string) FactoryWithContext {
+		atomic.AddInt32(&created, 1)
+		return func(ctx context.Context) (*grpc.ClientConn, error) {
+			return grpc.Dial(target, grpc.WithInsecure())
+		}
+	}, WithCapacity(4))
+
+	// Concurrent calls for the same target share a single pool
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.Get(context.Background(), "example.com"); err != nil {
+				t.Errorf("Get returned an error: %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	if c, err := m.Get(context.Background(), "example.org"); err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	} else if c.Target() != "example.org" {
+		t.Errorf("The connection target was %q but should be example.org", c.Target())
+	}
+	if n := atomic.LoadInt32(&created); n != 2 {
+		t.Errorf("%d pools were created but should be 2", n)
+	}
+
+	stats := m.Stats()
+	if s := stats["example.com"]; s.Capacity != 4 || s.InUse != 4 {
+		t.Errorf("The example.com stats were %+v", s)
+	}
+	if s := stats["example.org"]; s.InUse != 1 {
+		t.Errorf("The example.org stats were %+v", s)
+	}
+
+	m.CloseAll()
+	if _, err := m.Get(context.Background(), "example.com"); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+	if stats := m.Stats(); len(stats) != 0 {
+		t.Errorf("The closed manager shouldn't have any stats")
+	}
+}
+
+func TestPoolManagerDrain(t *testing.T) {
+	m := NewManager(func(target string) FactoryWithContext {
+		return func(ctx context.Context) (*grpc.ClientConn, error) {
+			return grpc.Dial(target, grpc.WithInsecure())
+		}
+	}, WithCapacity(2))
+
+	c, err := m.Get(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+
+	// The checked out connection keeps Drain waiting
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Drain(context.Background())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Drain returned before the connection was given back: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if _, err := m.Get(context.Background(), "example.com"); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+
+	c.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Drain returned an error: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain should have returned once the connection was given back")
+	}
+}
+
+func TestPoolManagerLimits(t *testing.T) {
+	clk := newFakeClock()
+	m := NewManagerWithLimits(func(target string) FactoryWithContext {
+		return func(ctx context.Context) (*grpc.ClientConn, error) {
+			return grpc.Dial(target, grpc.WithInsecure())
+		}
+	}, ManagerLimits{TTL: time.Minute, MaxEntries: 2}, WithCapacity(1))
+	m.clock = clk
+	defer m.CloseAll()
+
+	pool := func(target string) *Pool {
+		p, err := m.pool(context.Background(), target)
+		if err != nil {
+			t.Fatalf("The pool of %s returned an error: %s", target, err.Error())
+		}
+		return p
+	}
+
+	// The least recently used pool makes room for a new target
+	a := pool("a.example.com")
+	clk.Advance(time.Second)
+	b := pool("b.example.com")
+	clk.Advance(time.Second)
+	pool("a.example.com")
+	pool("c.example.com")
+	if !b.IsClosed() || a.IsClosed() {
+		t.Error("The least recently used pool should have been closed")
+	}
+	if stats := m.Stats(); len(stats) != 2 {
+		t.Errorf("The manager held %d pools but should hold 2", len(stats))
+	}
+
+	// The pools unused for longer than the TTL are closed
+	clk.Advance(2 * time.Minute)
+	pool("c.example.com")
+	if !a.IsClosed() {
+		t.Error("The expired pool should have been closed")
+	}
+	if stats := m.Stats(); len(stats) != 1 {
+		t.Errorf("The manager held %d pools but should hold 1", len(stats))
+	}
+}
@@ -0,0 +1,506 @@
+package grpcpool
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Option is a function type configuring a pool created with NewWithOptions
+type Option func(*Pool)
+
+// WithFactory sets the factory creating the connections of a pool set up
+// with Init
+func WithFactory(factory FactoryWithContext) Option {
+	return func(p *Pool) {
+		p.factory = factory
+	}
+}
+
+// WithTiers creates the connections of the pool with the dialers of several
+// tiers, such as a primary and a fallback region, instead of the factory. Each
+// new connection, initial or created by Get, goes to the weighted tier with
+// the fewest connections relative to its weight, so that the connections are
+// split across the tiers proportionally to their weights whatever the
+// capacity. A recycled connection frees its place in its tier, which the next
+// connection created then fills.
+//
+// When the dial of a tier fails, the other tiers are tried in order, the
+// tiers with a weight of 0 being only used then. While a whole tier is down
+// the pool is filled from the others, the balance being restored as these
+// connections get recycled, for instance through WithMaxLife
+func WithTiers(tiers []Tier) Option {
+	return func(p *Pool) {
+		p.tiers = newTierSet(tiers)
+		p.factory = p.tiers.dial
+	}
+}
+
+// WithTierPreference makes Get hand out the idle connection of the first tier
+// in the WithTiers list rather than follow the checkout order. It replaces
+// WithConnSelector
+func WithTierPreference() Option {
+	return func(p *Pool) {
+		p.selector = p.preferTier
+	}
+}
+
+// WithName names the pool, for instance after its target. The errors of the
+// pool are then PoolError values carrying the name, so that they can be told
+// apart in a process running many pools
+func WithName(name string) Option {
+	return func(p *Pool) {
+		p.name = name
+	}
+}
+
+// WithStrictConfig makes the pool creation fail with an error wrapping
+// ErrInvalidConfig when the options are out of bounds, such as a capacity of
+// 0 or more initial connections than the capacity, instead of silently
+// bringing them back within bounds
+func WithStrictConfig() Option {
+	return func(p *Pool) {
+		p.strict = true
+	}
+}
+
+// WithCapacity sets the maximum number of clients of the pool
+func WithCapacity(capacity int) Option {
+	return func(p *Pool) {
+		p.capacity = capacity
+		p.capacitySet = true
+	}
+}
+
+// WithInitialConns sets the number of clients created when the pool is
+// initialized
+func WithInitialConns(init int) Option {
+	return func(p *Pool) {
+		p.init = init
+	}
+}
+
+// WithDialTimeout bounds the time each factory call can take, through the
+// deadline of the context passed to the factory. A timeout of 0 leaves the
+// factory bounded by the context of Get only
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(p *Pool) {
+		p.dialTimeout = timeout
+	}
+}
+
+// WithEagerConnect suits the factories built on grpc.NewClient, whose
+// connections only connect on their first RPC: every new connection is made
+// to connect right away, and the pool creation waits up to timeout for each
+// initial connection to be ready. An initial connection not ready in time
+// fails like a failed dial, with an error wrapping ErrNotReady, so that the
+// pool creation still guarantees usable connections. Pair it with
+// WithWaitForReady for the connections created by Get
+func WithEagerConnect(timeout time.Duration) Option {
+	return func(p *Pool) {
+		p.eagerTimeout = timeout
+	}
+}
+
+// WithBackgroundWarmup makes the pool creation return right away, without
+// any connection, and the WithInitialConns connections be created in the
+// background. Get creates a connection as usual until then. A failed
+// background dial is only retried with WithInitRetry, the connection being
+// created by Get when needed otherwise, and WithTolerateInitFailures doesn't
+// apply
+func WithBackgroundWarmup() Option {
+	return func(p *Pool) {
+		p.warmup = true
+	}
+}
+
+// WithGetTimeout bounds the time Get, and the other methods checking out
+// clients, wait for a client to become available, whatever the deadline of
+// their context: they return ErrTimeout once timeout elapsed. It covers the
+// whole checkout, including the wait for a paused pool to resume, for a
+// WithPartitions slot or for the turn of a GetN batch. GetWithin
+// replaces it with its own bound. A timeout of 0 lets them wait as long as
+// their context allows
+func WithGetTimeout(timeout time.Duration) Option {
+	return func(p *Pool) {
+		p.getTimeout = timeout
+	}
+}
+
+// WithIdleTimeout sets the duration after which an idle client gets
+// recycled. A timeout of 0 disables the idle recycling
+func WithIdleTimeout(idleTimeout time.Duration) Option {
+	return func(p *Pool) {
+		p.idleTimeout = idleTimeout
+	}
+}
+
+// WithMaxLife sets the maximum duration a client can live before being
+// recycled. A duration of 0 disables the recycling
+func WithMaxLife(maxLifeDuration time.Duration) Option {
+	return func(p *Pool) {
+		p.maxLifeDuration = maxLifeDuration
+	}
+}
+
+// WithMaxRequestsPerConn makes Close recycle a client once it was checked out
+// n times, so that the load gets rebalanced across the servers behind a load
+// balancer pinning the connections. A value of 0 disables the recycling
+func WithMaxRequestsPerConn(n int) Option {
+	return func(p *Pool) {
+		p.maxRequests = n
+	}
+}
+
+// WithMaxLifeJitter spreads the max life of the clients so that the ones
+// created together aren't recycled together: each client gets a max life
+// picked at random within fraction of the WithMaxLife duration on both sides,
+// fraction being between 0 and 1
+func WithMaxLifeJitter(fraction float64) Option {
+	return func(p *Pool) {
+		p.maxLifeJitter = fraction
+	}
+}
+
+// WithWaitForReady makes Get wait, up to the given timeout, for the client
+// to reach the READY state before returning it. If the client isn't ready in
+// time, Get returns it along with an error wrapping ErrNotReady, unless
+// WithRecycleNotReady is also set
+func WithWaitForReady(timeout time.Duration) Option {
+	return func(p *Pool) {
+		p.readyTimeout = timeout
+	}
+}
+
+// WithRecycleNotReady makes Get close a client that didn't become ready
+// within the WithWaitForReady timeout and retry with a new one, until the
+// context passed to Get is done
+func WithRecycleNotReady() Option {
+	return func(p *Pool) {
+		p.recycleNotReady = true
+	}
+}
+
+// WithFactoryContext sets a function deriving the context passed to the
+// factory when Get creates a new connection from the context passed to Get.
+// It lets the factory read values, such as credentials, that the callers of
+// Get don't carry while still honoring their deadline and cancellation
+func WithFactoryContext(fn func(getCtx context.Context) context.Context) Option {
+	return func(p *Pool) {
+		p.factoryCtx = fn
+	}
+}
+
+// WithCheckoutOrder sets the order in which Get hands out the idle clients.
+// It defaults to FIFO
+func WithCheckoutOrder(order CheckoutOrder) Option {
+	return func(p *Pool) {
+		p.order = order
+	}
+}
+
+// WithReturnToFront makes Close put the clients given back where they're the
+// next to be handed out, rather than behind the other idle clients, so that a
+// lightly loaded pool keeps reusing the same few connections. It only matters
+// with the FIFO order, LIFO already doing so for every client. As Get then
+// mostly hands out the most recently used clients, the idle timeout rarely
+// recycles anything on checkout: pair it with WithReapInterval to close the
+// clients left unused at the back
+func WithReturnToFront() Option {
+	return func(p *Pool) {
+		p.returnToFront = true
+	}
+}
+
+// WithCircuitBreaker makes the pool stop calling the factory after
+// failureThreshold consecutive failures: Get then fails fast with
+// ErrCircuitOpen when it needs a new connection. Once cooldown elapsed, a
+// single probe dial is let through, closing the breaker if it succeeds
+func WithCircuitBreaker(failureThreshold int, cooldown time.Duration) Option {
+	return func(p *Pool) {
+		if failureThreshold <= 0 {
+			p.breaker = nil
+			return
+		}
+		p.breaker = &breaker{
+			threshold: failureThreshold,
+			cooldown:  cooldown,
+		}
+	}
+}
+
+// WithOnGet sets a hook called right before Get hands out a client, with the
+// time spent waiting for a client to become available. It isn't called when
+// Get fails
+func WithOnGet(fn func(c *ClientConn, waited time.Duration)) Option {
+	return func(p *Pool) {
+		p.onGet = fn
+	}
+}
+
+// AddOnGet is like WithOnGet, but calls fn after the OnGet hook set by the
+// previous options, if any, rather than replacing it. It lets a library add
+// its own hook, for instance to record metrics, without taking the hook of
+// the application over
+func AddOnGet(fn func(c *ClientConn, waited time.Duration)) Option {
+	return func(p *Pool) {
+		prev := p.onGet
+		if prev == nil {
+			p.onGet = fn
+			return
+		}
+		p.onGet = func(c *ClientConn, waited time.Duration) {
+			prev(c, waited)
+			fn(c, waited)
+		}
+	}
+}
+
+// WithOnPut sets a hook called when Close gives a client back to the pool
+func WithOnPut(fn func(c *ClientConn)) Option {
+	return func(p *Pool) {
+		p.onPut = fn
+	}
+}
+
+// WithOnHookPanic sets a callback called with the name of the hook and the
+// recovered value when a hook or function set with the other options panics.
+// The pool recovers from such panics whether this callback is set or not: a
+// panicking OnGet or OnPut doesn't prevent the client from being handed out
+// or given back, a panicking connection selector falls back to the checkout
+// order, and a panicking context enricher or factory context function to the
+// context passed to Get
+func WithOnHookPanic(fn func(hook string, recovered interface{})) Option {
+	return func(p *Pool) {
+		p.onHookPanic = fn
+	}
+}
+
+// WithRecycleOnGoAway makes Get recycle an idle client that was READY when it
+// was returned to the pool but has gone back to IDLE or CONNECTING since,
+// which is what happens when the server sends a GOAWAY
+func WithRecycleOnGoAway() Option {
+	return func(p *Pool) {
+		p.recycleGoAway = true
+	}
+}
+
+// WithTolerateInitFailures makes the pool attempt all its initial
+// connections instead of failing on the first error. The pool is created as
+// long as at least minSuccess of them succeeded, the failed ones being
+// created lazily by Get. Otherwise the connections are closed and a
+// MultiError describing every dial is returned
+func WithTolerateInitFailures(minSuccess int) Option {
+	return func(p *Pool) {
+		p.tolerateInit = true
+		p.minInit = minSuccess
+	}
+}
+
+// WithInitRetry makes the pool retry in the background the initial
+// connections whose dial failed, with WithTolerateInitFailures or
+// WithBackgroundWarmup, instead of leaving them to Get. The first retry
+// happens after minBackoff, the wait doubling after each failure up to
+// maxBackoff. The retries stop once Get created the connections or the pool
+// is closed
+func WithInitRetry(minBackoff, maxBackoff time.Duration) Option {
+	return func(p *Pool) {
+		p.initRetryMin = minBackoff
+		p.initRetryMax = maxBackoff
+	}
+}
+
+// WithOnFactoryError sets a hook called with the error each time the factory
+// fails to create a connection
+func WithOnFactoryError(fn func(err error)) Option {
+	return func(p *Pool) {
+		p.onFactoryError = fn
+	}
+}
+
+// AddOnFactoryError is like WithOnFactoryError, but calls fn after the hook
+// set by the previous options, if any, rather than replacing it
+func AddOnFactoryError(fn func(err error)) Option {
+	return func(p *Pool) {
+		prev := p.onFactoryError
+		if prev == nil {
+			p.onFactoryError = fn
+			return
+		}
+		p.onFactoryError = func(err error) {
+			prev(err)
+			fn(err)
+		}
+	}
+}
+
+// WithUnlimited removes the capacity of the pool: Get hands out an idle
+// client if there is one but creates a new one instead of waiting otherwise,
+// and every healthy client given back with Close is kept idle. The pool then
+// acts as a cache of connections rather than a limiter: pair it with
+// WithIdleTimeout and WithReapInterval so that the idle connections left
+// after a burst get closed
+func WithUnlimited() Option {
+	return func(p *Pool) {
+		p.unlimited = true
+	}
+}
+
+// WithReapInterval starts a background task closing, every interval, the
+// idle clients unused for longer than the idle timeout or older than the max
+// life duration. Without it, an idle client is only recycled when Get hands
+// it out
+func WithReapInterval(interval time.Duration) Option {
+	return func(p *Pool) {
+		p.reapInterval = interval
+	}
+}
+
+// WithBurst lets the pool grow beyond the softCap connections it normally
+// keeps up to hardCap during bursts, and shrink back once they're over: it
+// sets the capacity to hardCap, makes Get hand out the idle connections
+// before creating new ones like WithElasticCapacity, and closes the idle
+// connections beyond softCap once they were unused for burstTTL. Capacity
+// reports hardCap throughout, and Available the idle connections plus the
+// connections that can still be created up to hardCap. Only the idle
+// connections are closed, never the checked out ones, by the reaper if
+// WithReapInterval is set and by Get otherwise
+func WithBurst(softCap, hardCap int, burstTTL time.Duration) Option {
+	return func(p *Pool) {
+		p.capacity = hardCap
+		p.capacitySet = true
+		p.burstSoft = softCap
+		p.burstTTL = burstTTL
+		p.elastic = true
+	}
+}
+
+// WithMaxLifetimeConnections bounds to n the number of connections the
+// factory creates over the lifetime of the pool, as a last resort against a
+// factory creating connections that keep being recycled right away, or to
+// control costs. Once n connections were created, the existing connections
+// are still handed out but Get fails with ErrConnectionBudgetExhausted when
+// it needs a new one. Stats.Dials reports the connections created so far. A
+// value of 0 doesn't bound the connections
+func WithMaxLifetimeConnections(n int) Option {
+	return func(p *Pool) {
+		p.maxCreated = int64(n)
+	}
+}
+
+// WithFallback makes Get hand out cc, for instance a connection to a read
+// replica, when no client is available right away instead of waiting for
+// one. The handed out client is flagged with IsFallback, and closing it
+// leaves cc open without affecting the pool. cc is shared by all the callers
+// getting it, without any bound on their number, and the pool never closes
+// it. It has no effect on an unlimited pool, which never waits, nor on GetN
+// and GetForKey, which need clients of their own
+func WithFallback(cc *grpc.ClientConn) Option {
+	return func(p *Pool) {
+		p.fallback = cc
+	}
+}
+
+// WithDialConcurrency bounds to n the number of factory calls in flight at
+// once, so that a burst of Get on a cold pool doesn't dial all its
+// connections at the same time. The extra Get wait for a dial slot, up to
+// their context. A slot is freed as soon as the factory returns or the Get
+// that called it gives up, the factory call then finishing in the background
+// without counting against the bound. A limit of 0 removes the bound
+func WithDialConcurrency(n int) Option {
+	return func(p *Pool) {
+		if n <= 0 {
+			p.dialSem = nil
+			return
+		}
+		p.dialSem = make(chan struct{}, n)
+	}
+}
+
+// WithConnSelector makes Get pick the client to hand out with selector,
+// which is given the clients currently stored in the pool and returns the
+// index of the chosen one. The placeholders of the connections not created
+// yet are part of the candidates, with a nil ClientConn. An index out of
+// range falls back to the checkout order.
+//
+// The candidates are copied for every Get, an allocation proportional to the
+// capacity that the default order doesn't need. selector is called with the
+// pool locked: it must be fast and must not call the pool
+func WithConnSelector(selector func(candidates []*ClientConn) int) Option {
+	return func(p *Pool) {
+		p.selector = selector
+	}
+}
+
+// WithElasticCapacity makes the pool only allocate memory for its idle
+// connections, instead of for its whole capacity: the connections not created
+// yet or recycled are merely counted. It suits the services running many
+// mostly idle pools, for instance through a PoolManager. With it, Get hands
+// out the idle connections before creating new ones, whatever the checkout
+// order, and WithConnSelector only chooses among the idle connections
+func WithElasticCapacity() Option {
+	return func(p *Pool) {
+		p.elastic = true
+	}
+}
+
+// WithFailFastWhenUnhealthy makes Get fail right away with ErrAllUnhealthy
+// when the last dials failed and every connection of the pool, if any, was
+// marked as unhealthy, instead of spending the whole context cycling through
+// bad connections and failed dials. A second after the last failed dial, Get
+// tries to create a connection again, and stops failing fast once one does
+// or a healthy connection is given back
+func WithFailFastWhenUnhealthy() Option {
+	return func(p *Pool) {
+		p.failFast = true
+	}
+}
+
+// WithContextEnricher sets a function deriving, for the client handed out by
+// GetContext, the context of its RPCs from the context passed to GetContext.
+// It typically adds outgoing grpc metadata matching the connection, such as a
+// routing header. It must return a context derived from base, so that its
+// deadline and cancellation still apply
+func WithContextEnricher(fn func(base context.Context, c *ClientConn) context.Context) Option {
+	return func(p *Pool) {
+		p.enricher = fn
+	}
+}
+
+// WithMaxIdle bounds the number of idle connections kept by the pool: Close
+// closes the connection given back when there are already maxIdle idle ones,
+// and the pool creates a new connection when Get needs it. Bursts can still
+// use up to the capacity. A value of 0 keeps all the idle connections
+func WithMaxIdle(maxIdle int) Option {
+	return func(p *Pool) {
+		p.maxIdle = maxIdle
+	}
+}
+
+// WithPartitions splits the pool into named partitions, for instance one per
+// tenant or traffic class, each bounded to its limit of clients checked out at
+// once through GetForPartition, so that a noisy partition can't exhaust the
+// pool. The limits may add up to more than the capacity: the partitions then
+// still compete for the clients left. A limit of 0 or less doesn't bound the
+// partition
+func WithPartitions(limits map[string]int) Option {
+	return func(p *Pool) {
+		p.partitions = make(map[string]chan struct{}, len(limits))
+		for name, limit := range limits {
+			var sem chan struct{}
+			if limit > 0 {
+				sem = make(chan struct{}, limit)
+			}
+			p.partitions[name] = sem
+		}
+	}
+}
+
+// WithPauseBehavior sets what Get does while the pool is paused. It defaults
+// to PauseBlock
+func WithPauseBehavior(behavior PauseBehavior) Option {
+	return func(p *Pool) {
+		p.pauseBehavior = behavior
+	}
+}
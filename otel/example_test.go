@@ -0,0 +1,48 @@
+package otel_test
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+
+	grpcpool "github.com/processout/grpc-go-pool"
+	"github.com/processout/grpc-go-pool/otel"
+)
+
+func Example() {
+	inst, err := otel.New(tracenoop.NewTracerProvider(), noop.NewMeterProvider())
+	if err != nil {
+		panic(err)
+	}
+
+	opts := append([]grpcpool.Option{grpcpool.WithCapacity(4)}, inst.Options()...)
+	p, err := grpcpool.NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, opts...)
+	if err != nil {
+		panic(err)
+	}
+	defer p.Close()
+	reg, err := inst.Observe(p)
+	if err != nil {
+		panic(err)
+	}
+	defer reg.Unregister()
+
+	// invoke has the shape of a grpc.UnaryInvoker: it can be called from an
+	// interceptor to run each RPC on a pooled connection
+	invoke := func(ctx context.Context, method string, req, reply interface{},
+		opts ...grpc.CallOption) error {
+
+		c, err := inst.Get(ctx, p)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		return c.Invoke(ctx, method, req, reply, opts...)
+	}
+	_ = invoke
+}
@@ -0,0 +1,94 @@
+// Package otel instruments grpc pools with OpenTelemetry traces and metrics.
+// It only relies on the hooks of the grpcpool package, so that the core
+// package doesn't depend on OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	grpcpool "github.com/processout/grpc-go-pool"
+)
+
+const instrumentationName = "github.com/processout/grpc-go-pool/otel"
+
+// Instrumentation records the activity of grpc pools
+type Instrumentation struct {
+	tracer        trace.Tracer
+	meter         metric.Meter
+	active        metric.Int64ObservableGauge
+	checkout      metric.Float64Histogram
+	factoryErrors metric.Int64Counter
+}
+
+// New creates an instrumentation using the given tracer and meter providers
+func New(tp trace.TracerProvider, mp metric.MeterProvider) (*Instrumentation, error) {
+	meter := mp.Meter(instrumentationName)
+	active, err := meter.Int64ObservableGauge("grpcpool.connections.active",
+		metric.WithDescription("Number of checked out connections"))
+	if err != nil {
+		return nil, err
+	}
+	checkout, err := meter.Float64Histogram("grpcpool.checkout.duration",
+		metric.WithDescription("Time spent waiting for a connection to become available"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	factoryErrors, err := meter.Int64Counter("grpcpool.factory.errors",
+		metric.WithDescription("Number of connections the factory failed to create"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Instrumentation{
+		tracer:        tp.Tracer(instrumentationName),
+		meter:         meter,
+		active:        active,
+		checkout:      checkout,
+		factoryErrors: factoryErrors,
+	}, nil
+}
+
+// Options returns the pool options recording the metrics of the pool. Their
+// OnGet and OnFactoryError hooks are added to the ones set by the previous
+// options, the options of the application setting hooks must then come
+// first. The number of checked out connections is recorded by Observe.
+func (i *Instrumentation) Options() []grpcpool.Option {
+	return []grpcpool.Option{
+		grpcpool.AddOnGet(func(c *grpcpool.ClientConn, waited time.Duration) {
+			i.checkout.Record(context.Background(), waited.Seconds())
+		}),
+		grpcpool.AddOnFactoryError(func(err error) {
+			i.factoryErrors.Add(context.Background(), 1)
+		}),
+	}
+}
+
+// Observe records the number of checked out connections of p, as reported by
+// its stats, each time the metrics are collected. The returned registration
+// unregisters it, for instance once p is closed.
+func (i *Instrumentation) Observe(p *grpcpool.Pool) (metric.Registration, error) {
+	return i.meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		o.ObserveInt64(i.active, int64(p.Stats().InUse))
+		return nil
+	}, i.active)
+}
+
+// Get gets a client from the pool within a span, which covers the time spent
+// waiting for a client and creating its connection if needed
+func (i *Instrumentation) Get(ctx context.Context, p *grpcpool.Pool) (*grpcpool.ClientConn, error) {
+	ctx, span := i.tracer.Start(ctx, "grpcpool.Get")
+	defer span.End()
+
+	c, err := p.Get(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return c, err
+}
@@ -0,0 +1,127 @@
+package otel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+
+	grpcpool "github.com/processout/grpc-go-pool"
+	"github.com/processout/grpc-go-pool/otel"
+)
+
+// collect returns the metrics recorded by reader, by name
+func collect(t *testing.T, reader sdkmetric.Reader) map[string]metricdata.Aggregation {
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Collect returned an error: %s", err.Error())
+	}
+	metrics := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			metrics[m.Name] = m.Data
+		}
+	}
+	return metrics
+}
+
+func TestInstrumentation(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	spans := tracetest.NewSpanRecorder()
+	inst, err := otel.New(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)),
+		sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+
+	// The hooks of the application are still called
+	gets, factoryErrors := 0, 0
+	dialErr := errors.New("dial failed")
+	failing := false
+	opts := append([]grpcpool.Option{
+		grpcpool.WithCapacity(1),
+		grpcpool.WithOnGet(func(c *grpcpool.ClientConn, waited time.Duration) {
+			gets++
+		}),
+		grpcpool.WithOnFactoryError(func(err error) {
+			factoryErrors++
+		}),
+	}, inst.Options()...)
+	p, err := grpcpool.NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		if failing {
+			return nil, dialErr
+		}
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, opts...)
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+	reg, err := inst.Observe(p)
+	if err != nil {
+		t.Fatalf("Observe returned an error: %s", err.Error())
+	}
+	defer reg.Unregister()
+
+	c, err := inst.Get(context.Background(), p)
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	metrics := collect(t, reader)
+	active, ok := metrics["grpcpool.connections.active"].(metricdata.Gauge[int64])
+	if !ok || len(active.DataPoints) != 1 || active.DataPoints[0].Value != 1 {
+		t.Errorf("The active connections were %v but should be 1", metrics["grpcpool.connections.active"])
+	}
+	checkout, ok := metrics["grpcpool.checkout.duration"].(metricdata.Histogram[float64])
+	if !ok || len(checkout.DataPoints) != 1 || checkout.DataPoints[0].Count != 1 {
+		t.Errorf("The checkout durations were %v but should have 1 record", metrics["grpcpool.checkout.duration"])
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+
+	// The failed Get is recorded on its span and the failed dial counted
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	c.Unhealthy()
+	c.Close()
+	failing = true
+	if _, err := inst.Get(context.Background(), p); !errors.Is(err, dialErr) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", dialErr, err)
+	}
+	metrics = collect(t, reader)
+	active, _ = metrics["grpcpool.connections.active"].(metricdata.Gauge[int64])
+	if len(active.DataPoints) != 1 || active.DataPoints[0].Value != 0 {
+		t.Errorf("The active connections were %v but should be 0", metrics["grpcpool.connections.active"])
+	}
+	errs, ok := metrics["grpcpool.factory.errors"].(metricdata.Sum[int64])
+	if !ok || len(errs.DataPoints) != 1 || errs.DataPoints[0].Value != 1 {
+		t.Errorf("The factory errors were %v but should be 1", metrics["grpcpool.factory.errors"])
+	}
+
+	ended := spans.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("%d spans were recorded but should be 2", len(ended))
+	}
+	for i, code := range []otelcodes.Code{otelcodes.Unset, otelcodes.Error} {
+		if name := ended[i].Name(); name != "grpcpool.Get" {
+			t.Errorf("The span was named %s but should be grpcpool.Get", name)
+		}
+		if s := ended[i].Status().Code; s != code {
+			t.Errorf("The span status was %s but should be %s", s, code)
+		}
+	}
+
+	if gets != 2 || factoryErrors != 1 {
+		t.Errorf("The application hooks were called %d and %d times but should be 2 and 1", gets, factoryErrors)
+	}
+}
@@ -0,0 +1,56 @@
+package grpcpool
+
+import "context"
+
+// GetForPartition is like Get, but counts the client against the limit of
+// the WithPartitions partition, waiting up to ctx for one of the clients of
+// the partition to be given back when it's reached. It returns ErrTimeout if
+// ctx is done or WithGetTimeout elapsed first, and ErrUnknownPartition if the partition wasn't
+// declared. The client counts against the limit until it's closed.
+func (p *Pool) GetForPartition(ctx context.Context, partition string) (c *ClientConn, err error) {
+	defer func() {
+		err = p.named(err)
+	}()
+
+	sem, ok := p.partitions[partition]
+	if !ok {
+		return nil, ErrUnknownPartition
+	}
+	wait, stop := p.getWait()
+	defer stop()
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ErrTimeout
+		case <-wait:
+			return nil, ErrTimeout
+		}
+	}
+
+	c, err = p.get(ctx, wait, true)
+	if c == nil {
+		if sem != nil {
+			<-sem
+		}
+		return nil, err
+	}
+	// A client handed out along with an error, such as ErrNotReady, still
+	// has to be closed, releasing the slot
+	c.partition = sem
+	return c, err
+}
+
+// PartitionInUse returns the number of clients of the partition checked out
+// through GetForPartition, 0 for an unknown or unbounded partition
+func (p *Pool) PartitionInUse(partition string) int {
+	return len(p.partitions[partition])
+}
+
+// releasePartition frees the partition slot of the client, if any
+func (c *ClientConn) releasePartition() {
+	if c.partition != nil {
+		<-c.partition
+		c.partition = nil
+	}
+}
@@ -0,0 +1,62 @@
+package grpcpool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestPartitions(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(4), WithPartitions(map[string]int{"noisy": 2, "quiet": 0}))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	var noisy []*ClientConn
+	for i := 0; i < 2; i++ {
+		c, err := p.GetForPartition(context.Background(), "noisy")
+		if err != nil {
+			t.Fatalf("GetForPartition returned an error: %s", err.Error())
+		}
+		noisy = append(noisy, c)
+	}
+	if n := p.PartitionInUse("noisy"); n != 2 {
+		t.Errorf("The partition had %d clients in use but should have 2", n)
+	}
+
+	// The noisy partition reached its limit, the others still get clients
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetForPartition(ctx, "noisy"); err != ErrTimeout {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+	c, err := p.GetForPartition(context.Background(), "quiet")
+	if err != nil {
+		t.Fatalf("GetForPartition returned an error: %s", err.Error())
+	}
+	c.Close()
+	if _, err := p.GetForPartition(context.Background(), "unknown"); err != ErrUnknownPartition {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrUnknownPartition, err)
+	}
+
+	// Closing a client frees its slot, once
+	noisy[0].Close()
+	noisy[0].Close()
+	if n := p.PartitionInUse("noisy"); n != 1 {
+		t.Errorf("The partition had %d clients in use but should have 1", n)
+	}
+	c, err = p.GetForPartition(context.Background(), "noisy")
+	if err != nil {
+		t.Fatalf("GetForPartition returned an error: %s", err.Error())
+	}
+	c.Close()
+	noisy[1].Close()
+	if n := p.PartitionInUse("noisy"); n != 0 {
+		t.Errorf("The partition had %d clients in use but should have 0", n)
+	}
+}
@@ -0,0 +1,72 @@
+package grpcpool
+
+import (
+	"context"
+	"time"
+)
+
+// PauseBehavior is what Get does while the pool is paused
+type PauseBehavior int
+
+const (
+	// PauseBlock makes Get wait for the pool to be resumed, up to its
+	// context
+	PauseBlock PauseBehavior = iota
+	// PauseFail makes Get fail right away with ErrPaused
+	PauseFail
+)
+
+// Pause stops handing out clients until Resume is called, without closing
+// any connection. The checked out clients can still be given back, so that
+// the pool drains. Pausing a paused pool does nothing.
+func (p *Pool) Pause() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+
+	if p.paused == nil {
+		p.paused = make(chan struct{})
+	}
+}
+
+// Resume hands out clients again after Pause, waking up the Get calls
+// waiting for it. Resuming a pool that isn't paused does nothing.
+func (p *Pool) Resume() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+
+	if p.paused != nil {
+		close(p.paused)
+		p.paused = nil
+	}
+}
+
+// IsPaused returns true if the pool is paused
+func (p *Pool) IsPaused() bool {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+
+	return p.paused != nil
+}
+
+// waitResumed returns once the pool isn't paused. It returns ErrPaused right
+// away with PauseFail, and ErrTimeout if ctx is done or wait fires first
+func (p *Pool) waitResumed(ctx context.Context, wait <-chan time.Time) error {
+	p.pauseMu.Lock()
+	paused := p.paused
+	p.pauseMu.Unlock()
+
+	if paused == nil {
+		return nil
+	}
+	if p.pauseBehavior == PauseFail {
+		return ErrPaused
+	}
+	select {
+	case <-paused:
+		return nil
+	case <-ctx.Done():
+		return ErrTimeout
+	case <-wait:
+		return ErrTimeout
+	}
+}
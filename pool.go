@@ -4,10 +4,14 @@ package grpcpool
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 )
 
 var (
@@ -19,8 +23,129 @@ var (
 	ErrAlreadyClosed = errors.New("grpc pool: the connection was already closed")
 	// ErrFullPool is the error when the pool is already full
 	ErrFullPool = errors.New("grpc pool: closing a ClientConn into a full pool")
+	// ErrNotReady is the error when the client conn did not become ready in
+	// time
+	ErrNotReady = errors.New("grpc pool: the connection is not ready")
+	// ErrFactoryPanic is the error when the factory panicked
+	ErrFactoryPanic = errors.New("grpc pool: the factory panicked")
+	// ErrCircuitOpen is the error when the circuit breaker rejected the
+	// creation of a connection
+	ErrCircuitOpen = errors.New("grpc pool: circuit breaker is open")
+	// ErrNilConn is the error when the factory returned neither a client
+	// conn nor an error
+	ErrNilConn = errors.New("grpc pool: the factory returned a nil connection")
+	// ErrUnbalancedClose is the error when a client is closed while it isn't
+	// checked out, typically through a copy of an already closed wrapper
+	ErrUnbalancedClose = errors.New("grpc pool: the client was closed more times than it was checked out")
+	// ErrTooManyClients is the error when GetN asks for more clients than the
+	// capacity of the pool
+	ErrTooManyClients = errors.New("grpc pool: more clients requested than the pool capacity")
+	// ErrAllUnhealthy is the error when Get fails fast as all the
+	// connections are unhealthy and the factory keeps failing
+	ErrAllUnhealthy = errors.New("grpc pool: all connections are unhealthy")
+	// ErrNoFactory is the error when a pool is initialized without a
+	// factory
+	ErrNoFactory = errors.New("grpc pool: no factory")
+	// ErrInitialized is the error when Init is called on a pool that was
+	// already initialized
+	ErrInitialized = errors.New("grpc pool: pool already initialized")
+	// ErrConnectionBudgetExhausted is the error when the pool needs a new
+	// connection but already created the WithMaxLifetimeConnections ones
+	ErrConnectionBudgetExhausted = errors.New("grpc pool: connection budget exhausted")
+	// ErrInvalidConfig is the error when a pool created with
+	// WithStrictConfig has options out of bounds
+	ErrInvalidConfig = errors.New("grpc pool: invalid config")
+	// ErrPaused is the error when Get is called on a paused pool with the
+	// PauseFail behavior
+	ErrPaused = errors.New("grpc pool: pool is paused")
+	// ErrUnlimited is the error when resizing an unlimited pool
+	ErrUnlimited = errors.New("grpc pool: the pool is unlimited")
+	// ErrUnknownPartition is the error when GetForPartition is called with
+	// a partition WithPartitions didn't declare
+	ErrUnknownPartition = errors.New("grpc pool: unknown partition")
+	// ErrNoneAvailable is the error when TryGet finds all the clients
+	// checked out
+	ErrNoneAvailable = errors.New("grpc pool: no client available")
+	// ErrAlreadyRegistered is the error when registering a pool under a
+	// name already taken
+	ErrAlreadyRegistered = errors.New("grpc pool: a pool is already registered under this name")
 )
 
+// FactoryPanicError is the error returned when the factory panicked. It
+// carries the recovered value and matches ErrFactoryPanic with errors.Is
+type FactoryPanicError struct {
+	Value interface{}
+}
+
+func (e *FactoryPanicError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrFactoryPanic.Error(), e.Value)
+}
+
+// Is reports whether target is ErrFactoryPanic
+func (e *FactoryPanicError) Is(target error) bool {
+	return target == ErrFactoryPanic
+}
+
+// MultiError is the error returned when too many initial clients could not
+// be created with WithTolerateInitFailures. Errors holds the outcome of each
+// initial dial, in order: nil if it succeeded, its error otherwise
+type MultiError struct {
+	Errors []error
+}
+
+func (e *MultiError) Error() string {
+	var failed []string
+	for i, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("dial %d: %s", i+1, err.Error()))
+		}
+	}
+	return fmt.Sprintf("grpc pool: %d of %d initial connections failed: %s",
+		len(failed), len(e.Errors), strings.Join(failed, "; "))
+}
+
+// Unwrap returns the errors of the failed dials
+func (e *MultiError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// PoolError is the error returned by a pool named with WithName. It carries
+// the name of the pool along with the error, which errors.Is and errors.As
+// still see through
+type PoolError struct {
+	Pool string
+	Err  error
+}
+
+func (e *PoolError) Error() string {
+	return fmt.Sprintf("%s (pool %s)", e.Err.Error(), e.Pool)
+}
+
+// Unwrap returns the error of the pool
+func (e *PoolError) Unwrap() error {
+	return e.Err
+}
+
+// named wraps err in a PoolError if the pool was named with WithName
+func (p *Pool) named(err error) error {
+	if err == nil || p.name == "" {
+		return err
+	}
+	if _, ok := err.(*PoolError); ok {
+		return err
+	}
+	return &PoolError{
+		Pool: p.name,
+		Err:  err,
+	}
+}
+
 // Factory is a function type creating a grpc client
 type Factory func() (*grpc.ClientConn, error)
 
@@ -31,11 +156,90 @@ type FactoryWithContext func(context.Context) (*grpc.ClientConn, error)
 
 // Pool is the grpc client pool
 type Pool struct {
-	clients         chan ClientConn
+	clients         *connQueue
 	factory         FactoryWithContext
 	idleTimeout     time.Duration
 	maxLifeDuration time.Duration
+	maxLifeJitter   float64
+	init            int
+	capacity        int
+	readyTimeout    time.Duration
+	recycleNotReady bool
+	order           CheckoutOrder
+	selector        func([]*ClientConn) int
+	factoryCtx      func(context.Context) context.Context
+	enricher        func(context.Context, *ClientConn) context.Context
+	breaker         *breaker
+	onGet           func(*ClientConn, time.Duration)
+	onPut           func(*ClientConn)
+	onFactoryError  func(error)
+	onHookPanic     func(string, interface{})
+	name            string
+	returnToFront   bool
+	burstSoft       int
+	burstTTL        time.Duration
+	fallback        *grpc.ClientConn
+	capacitySet     bool
+	dialTimeout     time.Duration
+	eagerTimeout    time.Duration
+	getTimeout      time.Duration
+	warmup          bool
+	initErrs        []error
+	partitions      map[string]chan struct{}
+	// opts are the options the pool was created with, see Clone
+	opts            []Option
+	factorySet      bool
+	initRetryMin    time.Duration
+	initRetryMax    time.Duration
+	stopWarmup      context.CancelFunc
+	events          chan Event
+	eventsOn        int32
+	droppedEvents   int64
+	strict          bool
+	tiers           *tierSet
+	recycleGoAway   bool
+	saturation      chan SaturationState
+	saturated       int32
+	dialFailures    int32
+	lastDialFailure int64
+	failFast        bool
+	tolerateInit    bool
+	unlimited       bool
+	elastic         bool
+	maxIdle         int
+	maxRequests     int
+	reapInterval    time.Duration
+	done            chan struct{}
+	reaped          chan struct{}
+	generation      uint64
+	minInit         int
+	waitNanos       int64
+	waitBuckets     [4]int64
+	recycled        [recycleReasons]int64
+	dials           int64
+	dialNanos       int64
+	maxDialNanos    int64
+	lastSweep       int64
+	maxCreated      int64
+	budgetUsed      int64
+	batch           chan struct{}
+	pauseBehavior   PauseBehavior
+	paused          chan struct{}
+	pauseMu         sync.Mutex
+	dialSem         chan struct{}
+	clock           clock
+	initOnce        sync.Once
 	mu              sync.RWMutex
+
+	conns    map[*grpc.ClientConn]*connRecord
+	affinity map[string]*grpc.ClientConn
+	// live is the number of connections created by the factory or given to
+	// Put and not closed yet, drained is closed once it drops to 0 after
+	// the pool was closed
+	live    int
+	closing bool
+	drained chan struct{}
+	connsMu sync.Mutex
 }
 
 // ClientConn is the wrapper for a grpc client conn
@@ -44,7 +248,18 @@ type ClientConn struct {
 	pool          *Pool
 	timeUsed      time.Time
 	timeInitiated time.Time
+	maxLife       time.Duration
+	dialLatency   time.Duration
+	uses          int
 	unhealthy     bool
+	wasReady      bool
+	generation    uint64
+	fresh         bool
+	lease         uint64
+	dedicated     bool
+	fallback      bool
+	// partition is the quota slot taken by GetForPartition, if any
+	partition chan struct{}
 }
 
 // New creates a new clients pool with the given initial and maximum capacity,
@@ -63,46 +278,507 @@ func New(factory Factory, init, capacity int, idleTimeout time.Duration,
 func NewWithContext(ctx context.Context, factory FactoryWithContext, init, capacity int, idleTimeout time.Duration,
 	maxLifeDuration ...time.Duration) (*Pool, error) {
 
-	if capacity <= 0 {
-		capacity = 1
-	}
-	if init < 0 {
-		init = 0
+	opts := []Option{
+		WithInitialConns(init),
+		WithCapacity(capacity),
+		WithIdleTimeout(idleTimeout),
 	}
-	if init > capacity {
-		init = capacity
+	if len(maxLifeDuration) > 0 {
+		opts = append(opts, WithMaxLife(maxLifeDuration[0]))
 	}
+	return NewWithOptions(ctx, factory, opts...)
+}
+
+// NewWithOptions creates a new clients pool configured with the given
+// options. The capacity defaults to 1 and no client is initially created
+// unless WithCapacity and WithInitialConns are set. The context parameter
+// would be passed to the factory method during initialization. Returns an
+// error if the initial clients could not be created.
+func NewWithOptions(ctx context.Context, factory FactoryWithContext, opts ...Option) (*Pool, error) {
 	p := &Pool{
-		clients:     make(chan ClientConn, capacity),
-		factory:     factory,
-		idleTimeout: idleTimeout,
+		factory: factory,
 	}
-	if len(maxLifeDuration) > 0 {
-		p.maxLifeDuration = maxLifeDuration[0]
+	if err := p.initialize(ctx, opts); err != nil {
+		return nil, p.named(err)
+	}
+	return p, nil
+}
+
+// initialize sets the pool up, unless it already was
+func (p *Pool) initialize(ctx context.Context, opts []Option) error {
+	err := ErrInitialized
+	p.initOnce.Do(func() {
+		err = p.setup(ctx, opts)
+	})
+	return err
+}
+
+// setup applies the options to the pool and creates its initial clients
+func (p *Pool) setup(ctx context.Context, opts []Option) error {
+	p.clock = realClock{}
+	p.saturation = make(chan SaturationState, 1)
+	p.batch = make(chan struct{}, 1)
+	p.events = make(chan Event, eventsBuffer)
+	p.opts = opts
+	for _, opt := range opts {
+		opt(p)
 	}
-	for i := 0; i < init; i++ {
-		c, err := factory(ctx)
+	if p.getFactory() == nil {
+		return ErrNoFactory
+	}
+	if p.strict {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+
+	if p.unlimited {
+		p.capacity = -1
+	} else if p.capacity <= 0 {
+		p.capacity = 1
+	}
+	if p.init < 0 {
+		p.init = 0
+	}
+	if p.maxLifeJitter < 0 {
+		p.maxLifeJitter = 0
+	} else if p.maxLifeJitter > 1 {
+		p.maxLifeJitter = 1
+	}
+	if !p.unlimited && p.init > p.capacity {
+		p.init = p.capacity
+	}
+	if p.initRetryMax < p.initRetryMin {
+		p.initRetryMax = p.initRetryMin
+	}
+	if p.burstSoft < 0 {
+		p.burstSoft = 0
+	} else if !p.unlimited && p.burstSoft > p.capacity {
+		p.burstSoft = p.capacity
+	}
+	clients := newConnQueue(p.capacity, p.order, p.elastic)
+	clients.selector = p.selector
+	clients.onSelectorPanic = p.selectorPanicked
+	clients.returnToFront = p.returnToFront
+	if !p.unlimited {
+		clients.onLen = p.updateSaturation
+		clients.onWait = p.recordWait
+		clients.onBlock = func() {
+			p.emit(Event{Kind: GetBlocked})
+		}
+		clients.clock = p.clock
+	}
+
+	// The initial connections are only added to the pool once we know it'll
+	// be returned, so that they can be closed instead of leaked otherwise
+	// With WithBackgroundWarmup, they're created once the pool is returned
+	dials := p.init
+	if p.warmup {
+		dials = 0
+	}
+	conns := make([]*grpc.ClientConn, 0, dials)
+	latencies := make([]time.Duration, 0, dials)
+	errs := make([]error, dials)
+	failed := false
+	for i := 0; i < dials; i++ {
+		// Stop dialing as soon as the caller gave up on the pool
+		if err := ctx.Err(); err != nil {
+			p.closeConns(conns)
+			return err
+		}
+		c, latency, err := p.dial(ctx)
+		if err == nil {
+			p.track(c, false)
+			err = p.connectInit(ctx, c)
+		}
+		if err != nil {
+			if !p.tolerateInit {
+				p.closeConns(conns)
+				return err
+			}
+			errs[i] = err
+			failed = true
+			continue
+		}
+		conns = append(conns, c)
+		latencies = append(latencies, latency)
+	}
+	if failed && len(conns) < p.minInit {
+		p.closeConns(conns)
+		return &MultiError{Errors: errs}
+	}
+	for _, err := range errs {
 		if err != nil {
-			return nil, err
+			p.initErrs = append(p.initErrs, err)
 		}
+	}
 
-		p.clients <- ClientConn{
+	for i, c := range conns {
+		clients.put(ClientConn{
 			ClientConn:    c,
 			pool:          p,
-			timeUsed:      time.Now(),
-			timeInitiated: time.Now(),
-		}
+			timeUsed:      p.clock.Now(),
+			timeInitiated: p.clock.Now(),
+			maxLife:       p.connMaxLife(),
+			dialLatency:   latencies[i],
+			generation:    p.currentGeneration(),
+		})
 	}
 	// Fill the rest of the pool with empty clients
-	for i := 0; i < capacity-init; i++ {
-		p.clients <- ClientConn{
+	for i := 0; i < p.capacity-len(conns); i++ {
+		clients.put(ClientConn{
 			pool: p,
+		})
+	}
+
+	var warmupCtx context.Context
+	warmups, retries := 0, 0
+	if p.warmup {
+		warmups = p.init
+	} else if p.initRetryMin > 0 {
+		retries = len(p.initErrs)
+	}
+	if warmups > 0 || retries > 0 {
+		warmupCtx, p.stopWarmup = context.WithCancel(context.Background())
+	}
+	p.lastSweep = p.clock.Now().UnixNano()
+	p.mu.Lock()
+	p.clients = clients
+	p.mu.Unlock()
+
+	if p.reapInterval > 0 {
+		p.done = make(chan struct{})
+		p.reaped = make(chan struct{})
+		go p.reapLoop(p.reapInterval)
+	}
+	if warmups > 0 {
+		go p.warmUp(warmupCtx, warmups)
+	} else if retries > 0 {
+		go p.retryInit(warmupCtx, retries)
+	}
+	return nil
+}
+
+// connectInit makes an initial connection connect and waits for it to be
+// ready with WithEagerConnect. A connection not ready in time is closed
+func (p *Pool) connectInit(ctx context.Context, cc *grpc.ClientConn) error {
+	if p.eagerTimeout <= 0 {
+		return nil
+	}
+	readyCtx, cancel := context.WithTimeout(ctx, p.eagerTimeout)
+	defer cancel()
+
+	if state := waitForReady(readyCtx, cc); state != connectivity.Ready {
+		p.destroy(cc, recycleHealthCheck)
+		return fmt.Errorf("%w: connection is %s", ErrNotReady, state)
+	}
+	return nil
+}
+
+// InitErrors returns the errors of the initial dials that failed when the
+// pool was created with WithTolerateInitFailures, nil if they all succeeded.
+// The connections they were meant to create are created by Get instead
+func (p *Pool) InitErrors() []error {
+	return p.initErrs
+}
+
+// closeConns closes the given connections
+func (p *Pool) closeConns(conns []*grpc.ClientConn) {
+	for _, c := range conns {
+		p.destroy(c, recycleDiscarded)
+	}
+}
+
+// dial creates a new connection with the factory, unless the circuit breaker
+// is open, and returns how long the factory took to create it
+func (p *Pool) dial(ctx context.Context) (*grpc.ClientConn, time.Duration, error) {
+	// A dial reserves its share of the budget up front so that concurrent
+	// dials can't exceed it, a failed dial gives it back
+	if p.maxCreated > 0 && atomic.AddInt64(&p.budgetUsed, 1) > p.maxCreated {
+		atomic.AddInt64(&p.budgetUsed, -1)
+		return nil, 0, ErrConnectionBudgetExhausted
+	}
+	if p.breaker != nil && !p.breaker.allow(p.clock.Now()) {
+		p.refundBudget()
+		return nil, 0, ErrCircuitOpen
+	}
+
+	// The connection counts as live as soon as the factory is called, so
+	// that WaitClosed waits for the dials in flight too
+	p.created()
+	if _, _, dialTimeout := p.timeouts(); dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+	}
+	start := p.clock.Now()
+	cc, err := p.callFactory(ctx)
+	latency := p.clock.Now().Sub(start)
+	if p.breaker != nil {
+		p.breaker.done(err, p.clock.Now())
+	}
+	if err == nil {
+		atomic.StoreInt32(&p.dialFailures, 0)
+		p.recordDial(latency)
+		p.emit(Event{
+			Kind:   ConnCreated,
+			Target: cc.Target(),
+		})
+		if p.eagerTimeout > 0 {
+			cc.Connect()
+		}
+	} else {
+		atomic.AddInt32(&p.dialFailures, 1)
+		atomic.StoreInt64(&p.lastDialFailure, p.clock.Now().UnixNano())
+		p.refundBudget()
+		p.released()
+		if p.onFactoryError != nil {
+			p.safeCall("OnFactoryError", func() {
+				p.onFactoryError(err)
+			})
 		}
 	}
-	return p, nil
+	return cc, latency, err
+}
+
+// refundBudget gives back the share of the WithMaxLifetimeConnections budget
+// of a dial that didn't create a connection
+func (p *Pool) refundBudget() {
+	if p.maxCreated > 0 {
+		atomic.AddInt64(&p.budgetUsed, -1)
+	}
+}
+
+// dialResult is the outcome of a dial run in the background
+type dialResult struct {
+	cc      *grpc.ClientConn
+	latency time.Duration
+	err     error
+}
+
+// create dials the connection of a placeholder taken out of clients, putting
+// the placeholder back if it fails. The factory runs in the background so
+// that Get returns an error wrapping both ErrTimeout and ctx.Err() as soon as
+// ctx is done, even if the factory ignores ctx. The connection the factory
+// may still create afterward is then stored in clients as an idle client, in
+// place of the placeholder.
+func (p *Pool) create(ctx context.Context, clients *connQueue) (*grpc.ClientConn, time.Duration, error) {
+	// A context already done fails like a factory honoring it would, the
+	// pool didn't time out. The deadline is checked too as ctx.Err() is only
+	// set once the timer of the context fired
+	err := ctx.Err()
+	if deadline, ok := ctx.Deadline(); ok && err == nil && !time.Now().Before(deadline) {
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		clients.put(ClientConn{
+			pool: p,
+		})
+		return nil, 0, err
+	}
+	if !p.acquireDial(ctx) {
+		clients.put(ClientConn{
+			pool: p,
+		})
+		return nil, 0, fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+	}
+
+	if ctx.Done() == nil {
+		cc, latency, err := p.dial(p.factoryContext(ctx))
+		p.releaseDial()
+		if err != nil {
+			clients.put(ClientConn{
+				pool: p,
+			})
+		}
+		return cc, latency, err
+	}
+
+	// The dial slot is freed as soon as the Get gives up, so that a factory
+	// ignoring its context can't hold all the slots
+	var release sync.Once
+	done := make(chan dialResult, 1)
+	go func() {
+		cc, latency, err := p.dial(p.factoryContext(ctx))
+		release.Do(p.releaseDial)
+		done <- dialResult{cc: cc, latency: latency, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			clients.put(ClientConn{
+				pool: p,
+			})
+		}
+		return r.cc, r.latency, r.err
+	case <-ctx.Done():
+		release.Do(p.releaseDial)
+		go p.adopt(clients, done)
+		return nil, 0, fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+	}
 }
 
-func (p *Pool) getClients() chan ClientConn {
+// acquireDial waits for a dial slot when WithDialConcurrency is set. It
+// returns false if ctx is done first
+func (p *Pool) acquireDial(ctx context.Context) bool {
+	if p.dialSem == nil {
+		return true
+	}
+	select {
+	case p.dialSem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseDial frees the dial slot taken by acquireDial once the factory
+// returned
+func (p *Pool) releaseDial() {
+	if p.dialSem != nil {
+		<-p.dialSem
+	}
+}
+
+// adopt waits for a dial given up by create and stores its connection in
+// clients as an idle client, or a placeholder if the dial failed
+func (p *Pool) adopt(clients *connQueue, done <-chan dialResult) {
+	r := <-done
+	if r.err != nil {
+		clients.put(ClientConn{
+			pool: p,
+		})
+		return
+	}
+
+	p.track(r.cc, false)
+	err := clients.put(ClientConn{
+		ClientConn:    r.cc,
+		pool:          p,
+		timeUsed:      p.clock.Now(),
+		timeInitiated: p.clock.Now(),
+		maxLife:       p.connMaxLife(),
+		dialLatency:   r.latency,
+		generation:    p.currentGeneration(),
+	})
+	if err != nil {
+		p.destroy(r.cc, recycleDiscarded)
+	}
+}
+
+// callFactory calls the factory, turning a panic of the factory into a
+// FactoryPanicError and a nil connection into ErrNilConn so that the pool
+// bookkeeping still runs
+func (p *Pool) callFactory(ctx context.Context) (cc *grpc.ClientConn, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cc, err = nil, &FactoryPanicError{Value: r}
+		}
+	}()
+
+	cc, err = p.getFactory()(ctx)
+	if cc == nil && err == nil {
+		err = ErrNilConn
+	}
+	return cc, err
+}
+
+func (p *Pool) getFactory() FactoryWithContext {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.factory
+}
+
+// SetIdleTimeout changes the duration after which an idle client gets
+// recycled while the pool is in use, applying to all the idle clients right
+// away. A timeout of 0 disables the idle recycling
+func (p *Pool) SetIdleTimeout(idleTimeout time.Duration) {
+	if idleTimeout < 0 {
+		idleTimeout = 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.idleTimeout = idleTimeout
+}
+
+// SetMaxLifeDuration changes the duration after which a client gets recycled
+// while the pool is in use. A shorter duration applies to the existing
+// clients too, for instance to churn the connections faster during an
+// incident, while a longer one only applies to the clients created afterward.
+// A duration of 0 stops recycling the clients created afterward
+func (p *Pool) SetMaxLifeDuration(maxLifeDuration time.Duration) {
+	if maxLifeDuration < 0 {
+		maxLifeDuration = 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.maxLifeDuration = maxLifeDuration
+}
+
+// SetFactory replaces the factory used to create the connections of the
+// pool, for instance to rotate credentials. The existing connections are kept
+// until they get recycled, all the connections created afterward use the new
+// factory.
+func (p *Pool) SetFactory(factory FactoryWithContext) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.factory = factory
+	p.factorySet = true
+}
+
+// Put adds a connection created outside of the pool, for instance over a
+// bufconn listener in tests, as an idle client. It takes the place of a
+// connection not created yet, and returns ErrFullPool if all the connections
+// of the pool were already created. The pool then owns the connection.
+func (p *Pool) Put(cc *grpc.ClientConn) error {
+	if cc == nil {
+		return ErrNilConn
+	}
+	clients := p.initClients()
+	if clients == nil {
+		return ErrClosed
+	}
+
+	p.created()
+	p.track(cc, false)
+	ok := clients.fill(ClientConn{
+		ClientConn:    cc,
+		pool:          p,
+		timeUsed:      p.clock.Now(),
+		timeInitiated: p.clock.Now(),
+		maxLife:       p.connMaxLife(),
+		generation:    p.currentGeneration(),
+	})
+	if !ok {
+		p.untrack(cc)
+		p.released()
+		if p.IsClosed() {
+			return ErrClosed
+		}
+		return ErrFullPool
+	}
+	return nil
+}
+
+// factoryContext returns the context given to the factory when Get creates a
+// new connection
+func (p *Pool) factoryContext(ctx context.Context) context.Context {
+	if p.factoryCtx == nil {
+		return ctx
+	}
+	factoryCtx := ctx
+	p.safeCall("FactoryContext", func() {
+		factoryCtx = p.factoryCtx(ctx)
+	})
+	return factoryCtx
+}
+
+func (p *Pool) getClients() *connQueue {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
@@ -110,24 +786,76 @@ func (p *Pool) getClients() chan ClientConn {
 }
 
 // Close empties the pool calling Close on all its clients.
-// You can call Close while there are outstanding clients.
-// The pool channel is then closed, and Get will not be allowed anymore
+// You can call Close while there are outstanding clients, their connections
+// are closed when they're given back. Use WaitClosed to wait for them.
+// The pool queue is then closed, and Get will not be allowed anymore
 func (p *Pool) Close() {
+	p.CloseContext(context.Background())
+}
+
+// closeWorkers is the number of idle connections CloseContext closes at once
+const closeWorkers = 8
+
+// CloseContext is like Close, but gives up waiting for the idle connections
+// to be closed once ctx is done, returning ctx.Err(). The pool is closed
+// anyway, the connections still closing finish in the background.
+func (p *Pool) CloseContext(ctx context.Context) error {
+	// A zero-value pool closed before being initialized stays closed
+	p.initOnce.Do(func() {})
+
 	p.mu.Lock()
 	clients := p.clients
 	p.clients = nil
 	p.mu.Unlock()
 
 	if clients == nil {
-		return
+		return nil
 	}
+	// Wake up the Get calls waiting for the pool to be resumed, they then
+	// find it closed
+	p.Resume()
+	if p.done != nil {
+		close(p.done)
+	}
+	if p.stopWarmup != nil {
+		p.stopWarmup()
+	}
+	items := clients.close()
+	p.shutdown()
+	p.emit(Event{Kind: PoolClosed})
 
-	close(clients)
-	for client := range clients {
-		if client.ClientConn == nil {
-			continue
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if p.reaped != nil {
+			<-p.reaped
+		}
+
+		conns := make(chan *grpc.ClientConn)
+		var wg sync.WaitGroup
+		for i := 0; i < closeWorkers && i < len(items); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for cc := range conns {
+					p.destroy(cc, recycleDiscarded)
+				}
+			}()
 		}
-		client.ClientConn.Close()
+		for _, client := range items {
+			if client.ClientConn != nil {
+				conns <- client.ClientConn
+			}
+		}
+		close(conns)
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -138,79 +866,409 @@ func (p *Pool) IsClosed() bool {
 
 // Get will return the next available client. If capacity
 // has not been reached, it will create a new one using the factory. Otherwise,
-// it will wait till the next client becomes available or a timeout.
-// A timeout of 0 is an indefinite wait
+// it will wait till the next client becomes available or a timeout. An
+// unlimited pool never waits: it creates a new client if none is available.
+// A timeout of 0 is an indefinite wait. If WithWaitForReady is set, it then
+// waits for the client to become ready before returning it.
+// The client is checked out exclusively: it isn't handed out to anyone else
+// until it's given back with Close, so the capacity bounds the number of
+// concurrent checkouts.
 func (p *Pool) Get(ctx context.Context) (*ClientConn, error) {
-	clients := p.getClients()
+	c, err := p.get(ctx, nil, true)
+	return c, p.named(err)
+}
+
+// GetWithin is like Get, but waits at most maxWait for a client to become
+// available, independently of the deadline of ctx. It returns ErrTimeout once
+// maxWait elapsed even if ctx is still live, leaving the rest of the ctx
+// budget to the RPC. ctx is still used to create the connection if needed.
+func (p *Pool) GetWithin(ctx context.Context, maxWait time.Duration) (*ClientConn, error) {
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	c, err := p.get(ctx, timer.C, true)
+	return c, p.named(err)
+}
+
+// TryGet is like Get, but returns ErrNoneAvailable right away instead of
+// waiting when all the clients are checked out, so that the caller can fall
+// back to another strategy. It may still dial if a client wasn't created
+// yet: the dial is then bounded by the dial timeout of the pool, or by a
+// second without one, TryGet returning an error wrapping ErrTimeout if it
+// takes longer. The WithFallback connection isn't handed out.
+func (p *Pool) TryGet() (*ClientConn, error) {
+	_, _, timeout := p.timeouts()
+	if timeout <= 0 {
+		timeout = tryGetDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c, err := p.get(ctx, fired, false)
+	if err == ErrTimeout {
+		err = ErrNoneAvailable
+	}
+	return c, p.named(err)
+}
+
+// tryGetDialTimeout bounds the dial of TryGet when the pool has no dial
+// timeout
+const tryGetDialTimeout = time.Second
+
+// fired is a wait channel that has already fired
+var fired = func() chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
+// getWait returns the channel firing once the WithGetTimeout of a checkout
+// elapsed, nil without such a timeout, along with the function stopping it
+func (p *Pool) getWait() (<-chan time.Time, func()) {
+	if p.getTimeout <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(p.getTimeout)
+	return timer.C, func() { timer.Stop() }
+}
+
+// get implements Get, giving up waiting for a client when either ctx is done
+// or wait fires. A nil wait never fires. The WithFallback connection is only
+// handed out if fallback is set, GetN and GetForKey needing clients of their
+// own.
+func (p *Pool) get(ctx context.Context, wait <-chan time.Time, fallback bool) (*ClientConn, error) {
+	clients := p.initClients()
 	if clients == nil {
 		return nil, ErrClosed
 	}
+	if wait == nil {
+		var stop func()
+		wait, stop = p.getWait()
+		defer stop()
+	}
+	if err := p.waitResumed(ctx, wait); err != nil {
+		return nil, err
+	}
+	if p.failFast && p.unhealthy() {
+		return nil, ErrAllUnhealthy
+	}
 
-	wrapper := ClientConn{
-		pool: p,
+	var start time.Time
+	if p.onGet != nil {
+		start = p.clock.Now()
 	}
-	select {
-	case wrapper = <-clients:
-		// All good
-	case <-ctx.Done():
-		return nil, ErrTimeout // it would better returns ctx.Err()
+	fallback = fallback && p.fallback != nil && !p.unlimited
+	if fallback {
+		// Get the fallback connection rather than wait for a client
+		wait = fired
+	}
+	wrapper, err := clients.get(ctx, wait)
+	if err == ErrTimeout && fallback {
+		return &ClientConn{
+			ClientConn: p.fallback,
+			pool:       p,
+			timeUsed:   p.clock.Now(),
+			fallback:   true,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	var waited time.Duration
+	if p.onGet != nil {
+		waited = p.clock.Now().Sub(start)
+	}
+
+	return p.checkout(ctx, clients, wrapper, waited)
+}
+
+// checkout prepares a wrapper removed from the queue to be handed out:
+// recycling it if it was idle for too long, creating its connection if it's a
+// placeholder and waiting for it to be ready if needed. waited is the time
+// spent waiting for the wrapper, reported to the OnGet hook.
+func (p *Pool) checkout(ctx context.Context, clients *connQueue,
+	wrapper ClientConn, waited time.Duration) (*ClientConn, error) {
+
+	// An unlimited pool hands out bare placeholders when it's empty
+	wrapper.pool = p
 
 	// If the wrapper was idle too long, close the connection and create a new
-	// one. It's safe to assume that there isn't any newer client as the client
-	// we fetched is the first in the channel
-	idleTimeout := p.idleTimeout
+	// one. The clients Get doesn't hand out, which may have been idle for
+	// longer whatever the order, are recycled by the sweep
+	p.sweep()
+	idleTimeout, maxLife, _ := p.timeouts()
 	if wrapper.ClientConn != nil && idleTimeout > 0 &&
-		wrapper.timeUsed.Add(idleTimeout).Before(time.Now()) {
+		wrapper.timeUsed.Add(idleTimeout).Before(p.clock.Now()) {
 
-		wrapper.ClientConn.Close()
+		p.destroy(wrapper.ClientConn, recycleIdle)
 		wrapper.ClientConn = nil
 	}
 
+	// Same if it outlived its max life while it was idle
+	if wrapper.ClientConn != nil &&
+		p.expired(wrapper.timeInitiated, effectiveMaxLife(wrapper.maxLife, maxLife), p.clock.Now()) {
+
+		p.destroy(wrapper.ClientConn, recycleMaxLife)
+		wrapper.ClientConn = nil
+	}
+
+	// If the pool was reset since the connection was created, replace it
+	if wrapper.ClientConn != nil && wrapper.generation != p.currentGeneration() {
+		p.destroy(wrapper.ClientConn, recycleReset)
+		wrapper.ClientConn = nil
+	}
+
+	// If the connection was ready when it was returned but went back to idle
+	// or connecting since, the server most likely sent a GOAWAY: recycle it
+	// rather than handing out a connection the server asked us to drain
+	if wrapper.ClientConn != nil && p.recycleGoAway && wrapper.wasReady {
+		state := wrapper.ClientConn.GetState()
+		if state == connectivity.Idle || state == connectivity.Connecting {
+			p.destroy(wrapper.ClientConn, recycleHealthCheck)
+			wrapper.ClientConn = nil
+		}
+	}
+
 	var err error
 	if wrapper.ClientConn == nil {
-		wrapper.ClientConn, err = p.factory(ctx)
-		if err != nil {
-			// If there was an error, we want to put back a placeholder
-			// client in the channel
-			clients <- ClientConn{
-				pool: p,
-			}
+		wrapper.ClientConn, wrapper.dialLatency, err = p.create(ctx, clients)
+		if err == nil {
+			wrapper.lease = p.track(wrapper.ClientConn, true)
 		}
 		// This is a new connection, reset its initiated time
-		wrapper.timeInitiated = time.Now()
+		wrapper.timeInitiated = p.clock.Now()
+		wrapper.maxLife = p.connMaxLife()
+		wrapper.generation = p.currentGeneration()
+		wrapper.fresh = true
+		wrapper.uses = 0
+	} else {
+		wrapper.lease = p.markInUse(wrapper.ClientConn, true)
+	}
+	wrapper.uses++
+
+	if err == nil && p.readyTimeout > 0 {
+		err = p.waitForReady(ctx, clients, &wrapper)
+	}
+	if err == nil {
+		p.emit(Event{
+			Kind:   GetServed,
+			Target: wrapper.ClientConn.Target(),
+			Waited: waited,
+		})
+	}
+	if err == nil && p.onGet != nil {
+		p.safeCall("OnGet", func() {
+			p.onGet(&wrapper, waited)
+		})
 	}
 
 	return &wrapper, err
 }
 
+// waitForReady waits for the wrapper connection to become ready, giving it
+// at most the pool's ready timeout. If it isn't ready in time, the error
+// wraps ErrNotReady and the wrapper is left as is for the caller to decide.
+// When recycling is enabled, the connection is instead replaced with a new
+// one, and we wait again until ctx is done: the slot is then given back to
+// the pool as a placeholder.
+func (p *Pool) waitForReady(ctx context.Context, clients *connQueue,
+	wrapper *ClientConn) error {
+
+	for {
+		readyCtx, cancel := context.WithTimeout(ctx, p.readyTimeout)
+		state := waitForReady(readyCtx, wrapper.ClientConn)
+		cancel()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if !p.recycleNotReady {
+			return fmt.Errorf("%w: connection is %s", ErrNotReady, state)
+		}
+
+		p.destroy(wrapper.ClientConn, recycleHealthCheck)
+		wrapper.ClientConn = nil
+		if ctx.Err() != nil {
+			clients.put(ClientConn{
+				pool: p,
+			})
+			return ErrTimeout
+		}
+
+		var err error
+		wrapper.ClientConn, wrapper.dialLatency, err = p.create(ctx, clients)
+		if err != nil {
+			return err
+		}
+		wrapper.lease = p.track(wrapper.ClientConn, true)
+		wrapper.timeInitiated = p.clock.Now()
+		wrapper.maxLife = p.connMaxLife()
+		wrapper.generation = p.currentGeneration()
+		wrapper.fresh = true
+		wrapper.uses = 1
+	}
+}
+
+// waitForReady blocks until the connection is ready, shut down or ctx is
+// done, and returns the last state seen. A connection going through
+// TRANSIENT_FAILURE is still waited for, as grpc keeps reconnecting it in
+// the background.
+func waitForReady(ctx context.Context, cc *grpc.ClientConn) connectivity.State {
+	for {
+		state := cc.GetState()
+		switch state {
+		case connectivity.Ready, connectivity.Shutdown:
+			return state
+		case connectivity.Idle:
+			cc.Connect()
+		}
+		if !cc.WaitForStateChange(ctx, state) {
+			return cc.GetState()
+		}
+	}
+}
+
+// IsFallback returns true if Get handed out the WithFallback connection as
+// the pool was saturated
+func (c *ClientConn) IsFallback() bool {
+	return c.fallback
+}
+
+// IsFresh returns true if Get created the connection for this checkout, and
+// false if it was reused from the pool
+func (c *ClientConn) IsFresh() bool {
+	return c.fresh
+}
+
+// DialLatency returns how long the factory took to create the connection
+func (c *ClientConn) DialLatency() time.Duration {
+	return c.dialLatency
+}
+
+// State returns the connectivity state of the connection, SHUTDOWN if the
+// client was already closed
+func (c *ClientConn) State() connectivity.State {
+	if c == nil || c.ClientConn == nil {
+		return connectivity.Shutdown
+	}
+	return c.ClientConn.GetState()
+}
+
+// Target returns the target the connection was dialed to, or "" once the
+// client was closed
+func (c *ClientConn) Target() string {
+	if c == nil || c.ClientConn == nil {
+		return ""
+	}
+	return c.ClientConn.Target()
+}
+
+// WaitUntilReady blocks until the connection is ready. It returns ctx.Err()
+// if ctx is done first, and an error wrapping ErrNotReady if the connection
+// was shut down
+func (c *ClientConn) WaitUntilReady(ctx context.Context) error {
+	if c == nil || c.ClientConn == nil {
+		return fmt.Errorf("%w: connection is %s", ErrNotReady, connectivity.Shutdown)
+	}
+	state := waitForReady(ctx, c.ClientConn)
+	if state == connectivity.Ready {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: connection is %s", ErrNotReady, state)
+}
+
 // Unhealthy marks the client conn as unhealthy, so that the connection
 // gets reset when closed
 func (c *ClientConn) Unhealthy() {
 	c.unhealthy = true
+	if c.pool != nil && c.ClientConn != nil {
+		c.pool.markUnhealthy(c.ClientConn)
+		c.pool.emit(Event{
+			Kind:   ConnUnhealthy,
+			Target: c.ClientConn.Target(),
+		})
+	}
 }
 
 // Close returns a ClientConn to the pool. It is safe to call multiple time,
 // but will return an error after first time
-func (c *ClientConn) Close() error {
+func (c *ClientConn) Close() (err error) {
+	defer func() {
+		if c != nil && c.pool != nil {
+			err = c.pool.named(err)
+		}
+		// The checkout is over once the wrapper lost its connection
+		if c != nil && c.ClientConn == nil {
+			c.releasePartition()
+		}
+	}()
+
 	if c == nil {
 		return nil
 	}
 	if c.ClientConn == nil {
 		return ErrAlreadyClosed
 	}
+	if c.pool == nil {
+		// A wrapper built outside of a pool has no pool to go back to
+		return ErrClosed
+	}
+	if c.fallback {
+		// The fallback connection is shared, it stays open
+		c.ClientConn = nil
+		return nil
+	}
+	if c.dedicated {
+		c.pool.emit(Event{
+			Kind:   ConnClosed,
+			Target: c.ClientConn.Target(),
+			Age:    c.pool.clock.Now().Sub(c.timeInitiated),
+			Reason: "dedicated",
+		})
+		if c.pool.tiers != nil {
+			c.pool.tiers.forget(c.ClientConn)
+		}
+		err := c.ClientConn.Close()
+		c.pool.released()
+		c.ClientConn = nil
+		return err
+	}
 	if c.pool.IsClosed() {
+		// The pool was closed while the client was checked out, its
+		// connection is closed rather than given back
+		if c.pool.checkin(c.ClientConn, c.lease) {
+			c.pool.destroy(c.ClientConn, recycleDiscarded)
+		}
+		c.ClientConn = nil
 		return ErrClosed
 	}
-	// If the wrapper connection has become too old, we want to recycle it. To
-	// clarify the logic: if the sum of the initialization time and the max
-	// duration is before Now(), it means the initialization is so old adding
-	// the maximum duration couldn't put in the future. This sum therefore
-	// corresponds to the cut-off point: if it's in the future we still have
-	// time, if it's in the past it's too old
-	maxDuration := c.pool.maxLifeDuration
-	if maxDuration > 0 && c.timeInitiated.Add(maxDuration).Before(time.Now()) {
-		c.Unhealthy()
+	// Closing a copy of a wrapper already closed would give the same
+	// connection back twice, letting two callers share it
+	if !c.pool.checkin(c.ClientConn, c.lease) {
+		return ErrUnbalancedClose
+	}
+	reason := recycleUnhealthy
+	if !c.unhealthy {
+		// If the wrapper connection has become too old, we want to recycle
+		// it
+		_, maxLife, _ := c.pool.timeouts()
+		if c.pool.expired(c.timeInitiated, effectiveMaxLife(c.maxLife, maxLife), c.pool.clock.Now()) {
+			reason = recycleMaxLife
+			c.unhealthy = true
+		}
+		// Same once it served its share of checkouts
+		if max := c.pool.maxRequests; max > 0 && c.uses >= max {
+			reason = recycleMaxRequests
+			c.unhealthy = true
+		}
+		// If the pool was reset while the connection was checked out, we
+		// want to recycle it as well
+		if c.generation != c.pool.currentGeneration() {
+			reason = recycleReset
+			c.unhealthy = true
+		}
 	}
 
 	// We're cloning the wrapper so we can set ClientConn to nil in the one
@@ -218,37 +1276,114 @@ func (c *ClientConn) Close() error {
 	wrapper := ClientConn{
 		pool:       c.pool,
 		ClientConn: c.ClientConn,
-		timeUsed:   time.Now(),
+		timeUsed:   c.pool.clock.Now(),
 	}
 	if c.unhealthy {
-		wrapper.ClientConn.Close()
+		c.pool.destroy(wrapper.ClientConn, reason)
 		wrapper.ClientConn = nil
 	} else {
 		wrapper.timeInitiated = c.timeInitiated
+		wrapper.maxLife = c.maxLife
+		wrapper.dialLatency = c.dialLatency
+		wrapper.generation = c.generation
+		wrapper.uses = c.uses
+		if c.pool.recycleGoAway {
+			wrapper.wasReady = wrapper.ClientConn.GetState() == connectivity.Ready
+		}
 	}
-	select {
-	case c.pool.clients <- wrapper:
-		// All good
-	default:
-		return ErrFullPool
+	clients := c.pool.getClients()
+	evicted, err := false, ErrClosed
+	if clients != nil {
+		evicted, err = clients.putIdle(wrapper, c.pool.maxIdle)
+	}
+	if evicted {
+		// There are enough idle connections already
+		c.pool.destroy(wrapper.ClientConn, recycleMaxIdle)
+	}
+	if err == errSurplus {
+		// The pool shrank while the client was checked out
+		if wrapper.ClientConn != nil {
+			c.pool.destroy(wrapper.ClientConn, recycleResize)
+		}
+		c.ClientConn = nil
+		return nil
+	}
+	if err == ErrClosed {
+		if wrapper.ClientConn != nil {
+			c.pool.destroy(wrapper.ClientConn, recycleDiscarded)
+		}
+		c.ClientConn = nil
+		return err
+	}
+	if err != nil {
+		if wrapper.ClientConn != nil {
+			c.lease = c.pool.markInUse(wrapper.ClientConn, true)
+		}
+		return err
+	}
+	if c.pool.onPut != nil {
+		c.pool.safeCall("OnPut", func() {
+			c.pool.onPut(c)
+		})
 	}
 
 	c.ClientConn = nil // Mark as closed
 	return nil
 }
 
-// Capacity returns the capacity
+// Capacity returns the capacity, -1 for an unlimited pool
 func (p *Pool) Capacity() int {
 	if p.IsClosed() {
 		return 0
 	}
-	return cap(p.clients)
+	return p.getClients().cap()
 }
 
-// Available returns the number of currently unused clients
+// Available returns the number of clients that Get can hand out without
+// waiting: the idle connections plus the placeholders of the connections not
+// created yet. As a client is checked out exclusively, Available and InUse
+// add up to the capacity of a bounded pool
 func (p *Pool) Available() int {
 	if p.IsClosed() {
 		return 0
 	}
-	return len(p.clients)
+	return p.getClients().len()
+}
+
+// CapacityE is like Capacity, but returns ErrClosed once the pool is closed
+// instead of 0
+func (p *Pool) CapacityE() (int, error) {
+	clients := p.getClients()
+	if clients == nil {
+		return 0, ErrClosed
+	}
+	return clients.cap(), nil
+}
+
+// AvailableE is like Available, but returns ErrClosed once the pool is
+// closed instead of 0
+func (p *Pool) AvailableE() (int, error) {
+	clients := p.getClients()
+	if clients == nil {
+		return 0, ErrClosed
+	}
+	return clients.len(), nil
+}
+
+// InUse returns the number of connections currently checked out
+func (p *Pool) InUse() int {
+	if p.IsClosed() {
+		return 0
+	}
+
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	n := 0
+	for _, r := range p.conns {
+		if r.inUse {
+			n++
+		}
+	}
+	return n
 }
@@ -2,11 +2,18 @@ package grpcpool
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
 )
 
 func TestNew(t *testing.T) {
@@ -296,3 +303,3167 @@ func TestGetContextFactoryTimeout(t *testing.T) {
 		t.Errorf("Returned error was not context.DeadlineExceeded, but the context was timed out before the Get invocation")
 	}
 }
+
+// newTestServer starts a grpc server on a local port and returns its address
+func newTestServer(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned an error: %s", err.Error())
+	}
+	s := grpc.NewServer()
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	return lis.Addr().String()
+}
+
+// newRefusingAddress returns a local address nothing listens on
+func newRefusingAddress(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned an error: %s", err.Error())
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	return addr
+}
+
+func TestWaitForReady(t *testing.T) {
+	addr := newTestServer(t)
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial(addr, grpc.WithInsecure())
+	}, WithCapacity(1), WithWaitForReady(5*time.Second))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	if s := c.GetState(); s != connectivity.Ready {
+		t.Errorf("The connection state was %s but should be READY", s)
+	}
+}
+
+func TestWaitForReadyTransientFailure(t *testing.T) {
+	addr := newRefusingAddress(t)
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial(addr, grpc.WithInsecure())
+	}, WithCapacity(1), WithWaitForReady(50*time.Millisecond))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	// The connection gets refused, so it goes through TRANSIENT_FAILURE
+	// and never becomes ready: we should still get it back, with an error
+	c, err := p.Get(context.Background())
+	if !errors.Is(err, ErrNotReady) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrNotReady, err)
+	}
+	if c == nil || c.ClientConn == nil {
+		t.Fatal("The not ready connection should have been returned")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+}
+
+func TestWaitForReadyRecycle(t *testing.T) {
+	addr := newRefusingAddress(t)
+	count := 0
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		count++
+		return grpc.Dial(addr, grpc.WithInsecure())
+	}, WithCapacity(1), WithWaitForReady(20*time.Millisecond), WithRecycleNotReady())
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); err != ErrTimeout {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+	if count < 2 {
+		t.Errorf("The not ready connection should have been recycled")
+	}
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 2, 3, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	c.Unhealthy()
+
+	infos := p.Inspect()
+	if len(infos) != 2 {
+		t.Fatalf("Inspect returned %d connections but should be 2", len(infos))
+	}
+	inUse := 0
+	for _, info := range infos {
+		if info.Target != "example.com" {
+			t.Errorf("The target was %q but should be example.com", info.Target)
+		}
+		if info.InUse {
+			inUse++
+			if info.Healthy {
+				t.Errorf("The checked out connection should be unhealthy")
+			}
+		}
+	}
+	if inUse != 1 {
+		t.Errorf("There were %d connections in use but should be 1", inUse)
+	}
+
+	// Inspecting must not alter the pool
+	if a := p.Available(); a != 2 {
+		t.Errorf("The pool available was %d but should be 2", a)
+	}
+
+	// The unhealthy connection is closed when returned
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+	if infos := p.Inspect(); len(infos) != 1 {
+		t.Errorf("Inspect returned %d connections but should be 1", len(infos))
+	}
+
+	p.Close()
+	if infos := p.Inspect(); infos != nil {
+		t.Errorf("Inspect should return nil once the pool is closed")
+	}
+}
+
+// fakeClock is a clock only moving forward when told so
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestIdleTimeoutClock(t *testing.T) {
+	clk := newFakeClock()
+	count := 0
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		count++
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(1), WithIdleTimeout(time.Minute), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	// Just under the idle timeout, the connection is reused
+	clk.Advance(time.Minute - time.Second)
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("The connection shouldn't have been recycled")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+
+	// Past the idle timeout, it gets recycled
+	clk.Advance(time.Minute + time.Second)
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if count != 2 {
+		t.Errorf("The idle connection should have been recycled")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	clk := newFakeClock()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(2), WithInitialConns(2), WithMaxLife(time.Hour), withClock(clk))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	// A shorter max life applies to the existing clients, Get sweeping both
+	p.SetMaxLifeDuration(time.Minute)
+	clk.Advance(2 * time.Minute)
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	c.Close()
+	if r := p.Stats().RecycledMaxLife; r != 2 {
+		t.Errorf("The pool recycled %d clients for their max life but should recycle 2", r)
+	}
+
+	// The idle timeout applies right away
+	p.SetMaxLifeDuration(0)
+	p.SetIdleTimeout(time.Second)
+	clk.Advance(2 * time.Second)
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	c.Close()
+	if r := p.Stats().RecycledIdle; r != 1 {
+		t.Errorf("The pool recycled %d idle clients but should recycle 1", r)
+	}
+	if c := p.Config(); c.IdleTimeout != time.Second || c.MaxLifeDuration != 0 {
+		t.Errorf("The pool config was %+v", c)
+	}
+}
+
+func TestMaxLifeDurationClock(t *testing.T) {
+	clk := newFakeClock()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(1), WithMaxLife(time.Hour), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	clk.Advance(time.Hour - time.Second)
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+	if c.unhealthy {
+		t.Errorf("the connection shouldn't have been marked as unhealthy")
+	}
+
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	clk.Advance(2 * time.Second)
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+	if !c.unhealthy {
+		t.Errorf("the connection should've been marked as unhealthy")
+	}
+}
+
+func TestUnhealthyCloseDoesNotBlock(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 4, 4, 0, time.Nanosecond)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					c, err := p.Get(context.Background())
+					if err != nil {
+						t.Errorf("Get returned an error: %s", err.Error())
+						return
+					}
+					c.Unhealthy()
+					if err := c.Close(); err != nil {
+						t.Errorf("Close returned an error: %s", err.Error())
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Closing unhealthy connections blocked")
+	}
+	if a := p.Available(); a != 4 {
+		t.Errorf("The pool available was %d but should be 4", a)
+	}
+}
+
+func TestFactoryPanic(t *testing.T) {
+	_, err := New(func() (*grpc.ClientConn, error) {
+		panic("boom")
+	}, 1, 1, 0)
+	if !errors.Is(err, ErrFactoryPanic) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrFactoryPanic, err)
+	}
+
+	p, err := New(func() (*grpc.ClientConn, error) {
+		panic("boom")
+	}, 0, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	_, err = p.Get(context.Background())
+	var panicErr *FactoryPanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != "boom" {
+		t.Errorf("Expected a FactoryPanicError with \"boom\" but got \"%v\"", err)
+	}
+
+	// The slot must have been given back to the pool
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+}
+
+func TestFactoryContext(t *testing.T) {
+	type key struct{}
+	base := context.WithValue(context.Background(), key{}, "token")
+
+	var token interface{}
+	var deadline bool
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		token = ctx.Value(key{})
+		_, deadline = ctx.Deadline()
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithFactoryContext(func(getCtx context.Context) context.Context {
+		return context.WithValue(getCtx, key{}, base.Value(key{}))
+	}))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p.Get(ctx); err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if token != "token" {
+		t.Errorf("The factory context should carry the base context values")
+	}
+	if !deadline {
+		t.Errorf("The factory context should have a deadline")
+	}
+}
+
+func TestCloseIntoFullPool(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+
+	// Make the pool full behind the back of the checked out client
+	if err := p.getClients().put(ClientConn{pool: p}); err != nil {
+		t.Errorf("put returned an error: %s", err.Error())
+	}
+	if err := c.Close(); err != ErrFullPool {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrFullPool, err)
+	}
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+}
+
+func TestCloseWithoutPool(t *testing.T) {
+	cc, err := grpc.Dial("example.com", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial returned an error: %s", err.Error())
+	}
+	defer cc.Close()
+
+	c := &ClientConn{ClientConn: cc}
+	if err := c.Close(); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+}
+
+func TestUnbalancedClose(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+
+	// Closing a copy of the wrapper would give the client back twice
+	copied := *c
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+	if err := copied.Close(); err != ErrUnbalancedClose {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrUnbalancedClose, err)
+	}
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+
+	// The copy can't be given back while the client is checked out again
+	// either, or two callers would end up sharing it
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if c.ClientConn != copied.ClientConn {
+		t.Errorf("Get should have returned the same client")
+	}
+	if err := copied.Close(); err != ErrUnbalancedClose {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrUnbalancedClose, err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+}
+
+func TestGetWithin(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.GetWithin(context.Background(), time.Second)
+	if err != nil {
+		t.Errorf("GetWithin returned an error: %s", err.Error())
+	}
+
+	// The pool is exhausted: the wait budget runs out while ctx is live
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := p.GetWithin(ctx, 10*time.Millisecond); err != ErrTimeout {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("The context shouldn't be done")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+}
+
+func TestCheckoutOrder(t *testing.T) {
+	for _, order := range []CheckoutOrder{FIFO, LIFO} {
+		p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+			return grpc.Dial("example.com", grpc.WithInsecure())
+		}, WithInitialConns(2), WithCapacity(2), WithCheckoutOrder(order))
+		if err != nil {
+			t.Errorf("The pool returned an error: %s", err.Error())
+		}
+
+		c1, _ := p.Get(context.Background())
+		c2, _ := p.Get(context.Background())
+		cc1, cc2 := c1.ClientConn, c2.ClientConn
+		c1.Close()
+		c2.Close()
+
+		// FIFO hands out c1 first as it was returned first, LIFO hands out
+		// c2 first as it was returned last
+		expected := cc1
+		if order == LIFO {
+			expected = cc2
+		}
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		if c.ClientConn != expected {
+			t.Errorf("Get didn't hand out the expected connection in order %d", order)
+		}
+		p.Close()
+	}
+}
+
+func TestLIFOWaitTimeout(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithCheckoutOrder(LIFO))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); err != ErrTimeout {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+
+	// A waiting Get is woken up when the client is returned
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Close()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := p.Get(ctx); err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+}
+
+func TestGetForKey(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 3, 3, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.GetForKey(context.Background(), "session")
+	if err != nil {
+		t.Errorf("GetForKey returned an error: %s", err.Error())
+	}
+	cc := c.ClientConn
+	c.Close()
+
+	// Cycle the other clients so that the affine one isn't first anymore
+	for i := 0; i < 2; i++ {
+		o, _ := p.Get(context.Background())
+		o.Close()
+	}
+
+	c, err = p.GetForKey(context.Background(), "session")
+	if err != nil {
+		t.Errorf("GetForKey returned an error: %s", err.Error())
+	}
+	if c.ClientConn != cc {
+		t.Errorf("GetForKey should have returned the affine connection")
+	}
+
+	// While the affine client is checked out, another one is used
+	o, err := p.GetForKey(context.Background(), "session")
+	if err != nil {
+		t.Errorf("GetForKey returned an error: %s", err.Error())
+	}
+	if o.ClientConn == cc {
+		t.Errorf("GetForKey shouldn't have returned the checked out connection")
+	}
+	o.Close()
+
+	// Recycling the client forgets its keys
+	c.Close()
+	c, _ = p.GetForKey(context.Background(), "session")
+	c.Unhealthy()
+	c.Close()
+	p.connsMu.Lock()
+	keys := len(p.affinity)
+	p.connsMu.Unlock()
+	if keys != 0 {
+		t.Errorf("The keys of the recycled connection should have been forgotten")
+	}
+}
+
+func TestSetFactory(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 2, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	p.SetFactory(func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.org", grpc.WithInsecure())
+	})
+
+	// The existing connection is kept, the new one uses the new factory
+	c1, _ := p.Get(context.Background())
+	c2, _ := p.Get(context.Background())
+	if target := c1.Target(); target != "example.com" {
+		t.Errorf("The existing connection target was %q but should be example.com", target)
+	}
+	if target := c2.Target(); target != "example.org" {
+		t.Errorf("The new connection target was %q but should be example.org", target)
+	}
+}
+
+func TestCloseWhileGetBlocked(t *testing.T) {
+	count := 0
+	p, err := New(func() (*grpc.ClientConn, error) {
+		count++
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	// keep busy the available conn
+	if _, err := p.Get(context.Background()); err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := p.Get(context.Background())
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Close()
+
+	select {
+	case err := <-errs:
+		if err != ErrClosed {
+			t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get was still blocked after the pool was closed")
+	}
+	if count != 1 {
+		t.Errorf("The blocked Get shouldn't have created a connection")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	clk := newFakeClock()
+	failing := true
+	count := 0
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		count++
+		if failing {
+			return nil, errors.New("backend down")
+		}
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithCircuitBreaker(2, time.Minute), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	// Two failures open the breaker, the factory isn't called anymore
+	for i := 0; i < 2; i++ {
+		if _, err := p.Get(context.Background()); err == nil || err == ErrCircuitOpen {
+			t.Errorf("Expected the factory error but got \"%v\"", err)
+		}
+	}
+	if _, err := p.Get(context.Background()); err != ErrCircuitOpen {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrCircuitOpen, err)
+	}
+	if count != 2 {
+		t.Errorf("The factory was called %d times but should be 2", count)
+	}
+
+	// After the cooldown a failing probe opens it again
+	clk.Advance(time.Minute)
+	if _, err := p.Get(context.Background()); err == nil || err == ErrCircuitOpen {
+		t.Errorf("Expected the factory error but got \"%v\"", err)
+	}
+	if _, err := p.Get(context.Background()); err != ErrCircuitOpen {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrCircuitOpen, err)
+	}
+
+	// A successful probe closes it
+	failing = false
+	clk.Advance(time.Minute)
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	c.Unhealthy()
+	c.Close()
+	if _, err := p.Get(context.Background()); err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if count != 5 {
+		t.Errorf("The factory was called %d times but should be 5", count)
+	}
+	if a := p.Available(); a != 0 {
+		t.Errorf("The pool available was %d but should be 0", a)
+	}
+}
+
+func TestOnGetOnPut(t *testing.T) {
+	var gets, puts int32
+	var waited time.Duration
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithOnGet(func(c *ClientConn, w time.Duration) {
+		atomic.AddInt32(&gets, 1)
+		waited = w
+		if c.ClientConn == nil {
+			t.Errorf("OnGet was called without a connection")
+		}
+	}), WithOnPut(func(c *ClientConn) {
+		atomic.AddInt32(&puts, 1)
+	}))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+
+	// The second Get waits for the first client to be returned
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.Close()
+	}()
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if waited < 20*time.Millisecond {
+		t.Errorf("The wait was %s but should be at least 20ms", waited)
+	}
+	c.Close()
+
+	// The first Close may still be running its hook
+	time.Sleep(10 * time.Millisecond)
+	if g, p := atomic.LoadInt32(&gets), atomic.LoadInt32(&puts); g != 2 || p != 2 {
+		t.Errorf("The hooks were called %d and %d times but should be 2", g, p)
+	}
+}
+
+func TestRecycleOnGoAway(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned an error: %s", err.Error())
+	}
+	s := grpc.NewServer()
+	go s.Serve(lis)
+
+	count := 0
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		count++
+		return grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	}, WithCapacity(1), WithRecycleOnGoAway())
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	cc := c.ClientConn
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if state := waitForReady(ctx, cc); state != connectivity.Ready {
+		t.Fatalf("The connection state was %s but should be READY", state)
+	}
+	c.Close()
+
+	// Stopping the server sends a GOAWAY, the connection leaves READY
+	s.GracefulStop()
+	cc.WaitForStateChange(ctx, connectivity.Ready)
+
+	c, _ = p.Get(context.Background())
+	if c.ClientConn == cc {
+		t.Errorf("The drained connection should have been recycled")
+	}
+	if count != 2 {
+		t.Errorf("The factory was called %d times but should be 2", count)
+	}
+}
+
+func TestSaturationEvents(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 2, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	events := p.SaturationEvents()
+
+	c1, _ := p.Get(context.Background())
+	select {
+	case s := <-events:
+		t.Errorf("Unexpected %s event while a client is still available", s)
+	default:
+	}
+
+	c2, _ := p.Get(context.Background())
+	if s := <-events; s != Saturated {
+		t.Errorf("The event was %s but should be Saturated", s)
+	}
+
+	c1.Close()
+	if s := <-events; s != Recovered {
+		t.Errorf("The event was %s but should be Recovered", s)
+	}
+
+	// A consumer not keeping up only gets the latest state
+	c1, _ = p.Get(context.Background())
+	c1.Close()
+	c1, _ = p.Get(context.Background())
+	if s := <-events; s != Saturated {
+		t.Errorf("The event was %s but should be Saturated", s)
+	}
+	select {
+	case s := <-events:
+		t.Errorf("Unexpected %s event", s)
+	default:
+	}
+	c1.Close()
+	c2.Close()
+}
+
+func TestInitFailures(t *testing.T) {
+	var conns []*grpc.ClientConn
+	factory := func(ctx context.Context) (*grpc.ClientConn, error) {
+		if len(conns) == 1 {
+			conns = append(conns, nil)
+			return nil, errors.New("dial failed")
+		}
+		c, err := grpc.Dial("example.com", grpc.WithInsecure())
+		conns = append(conns, c)
+		return c, err
+	}
+
+	// By default the pool fails on the 2nd dial, closing the 1st connection
+	_, err := NewWithOptions(context.Background(), factory, WithInitialConns(3), WithCapacity(3))
+	if err == nil || err.Error() != "dial failed" {
+		t.Errorf("Expected the factory error but got \"%v\"", err)
+	}
+	if len(conns) != 2 || conns[0].GetState() != connectivity.Shutdown {
+		t.Errorf("The first connection should have been closed")
+	}
+
+	// The pool can start with the successful connections
+	conns = nil
+	p, err := NewWithOptions(context.Background(), factory, WithInitialConns(3), WithCapacity(3),
+		WithTolerateInitFailures(2))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	if a := p.Available(); a != 3 {
+		t.Errorf("The pool available was %d but should be 3", a)
+	}
+	if o := p.Stats().Open; o != 2 {
+		t.Errorf("The pool had %d open connections but should have 2", o)
+	}
+	if errs := p.InitErrors(); len(errs) != 1 || errs[0].Error() != "dial failed" {
+		t.Errorf("The pool should record the failed dial but got %v", errs)
+	}
+
+	// Or fail describing every dial
+	conns = nil
+	_, err = NewWithOptions(context.Background(), factory, WithInitialConns(3), WithCapacity(3),
+		WithTolerateInitFailures(3))
+	var multiErr *MultiError
+	if !errors.As(err, &multiErr) {
+		t.Fatalf("Expected a MultiError but got \"%v\"", err)
+	}
+	if multiErr.Errors[0] != nil || multiErr.Errors[1] == nil || multiErr.Errors[2] != nil {
+		t.Errorf("The MultiError should only hold the 2nd dial error: %v", multiErr.Errors)
+	}
+	if conns[0].GetState() != connectivity.Shutdown || conns[2].GetState() != connectivity.Shutdown {
+		t.Errorf("The successful connections should have been closed")
+	}
+}
+
+func TestContextCancelationDuringInit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var conns []*grpc.ClientConn
+	_, err := NewWithContext(ctx, func(ctx context.Context) (*grpc.ClientConn, error) {
+		// The context gets cancelled during the first dial
+		cancel()
+		c, err := grpc.Dial("example.com", grpc.WithInsecure())
+		conns = append(conns, c)
+		return c, err
+	}, 3, 3, 0)
+
+	if err != context.Canceled {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", context.Canceled, err)
+	}
+	if len(conns) != 1 {
+		t.Fatalf("The factory was called %d times but should be 1", len(conns))
+	}
+	if conns[0].GetState() != connectivity.Shutdown {
+		t.Errorf("The dialed connection should have been closed")
+	}
+}
+
+func TestReset(t *testing.T) {
+	count := 0
+	p, err := New(func() (*grpc.ClientConn, error) {
+		count++
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 2, 3, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	checkedOut := c.ClientConn
+	before := p.Inspect()
+
+	if err := p.Reset(); err != nil {
+		t.Errorf("Reset returned an error: %s", err.Error())
+	}
+	if a := p.Available(); a != 2 {
+		t.Errorf("The pool available was %d but should be 2", a)
+	}
+	if o := p.Stats().Open; o != 1 {
+		t.Errorf("The pool had %d open connections but should have 1", o)
+	}
+	if len(before) != 2 {
+		t.Fatalf("Inspect returned %d connections but should be 2", len(before))
+	}
+
+	// The checked out connection is recycled when returned
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+	if checkedOut.GetState() != connectivity.Shutdown {
+		t.Errorf("The checked out connection should have been closed")
+	}
+	if a := p.Available(); a != 3 {
+		t.Errorf("The pool available was %d but should be 3", a)
+	}
+
+	// New connections are created afterward
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if count != 3 {
+		t.Errorf("The factory was called %d times but should be 3", count)
+	}
+	c.Close()
+
+	p.Close()
+	if err := p.Reset(); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+}
+
+func TestFactoryNilConn(t *testing.T) {
+	_, err := New(func() (*grpc.ClientConn, error) {
+		return nil, nil
+	}, 1, 1, 0)
+	if err != ErrNilConn {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrNilConn, err)
+	}
+
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return nil, nil
+	}, 0, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	if _, err := p.Get(context.Background()); err != ErrNilConn {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrNilConn, err)
+	}
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+}
+
+func TestOnFactoryError(t *testing.T) {
+	var errs []error
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return nil, errors.New("dial failed")
+	}, WithOnFactoryError(func(err error) {
+		errs = append(errs, err)
+	}))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	p.Get(context.Background())
+	if len(errs) != 1 || errs[0].Error() != "dial failed" {
+		t.Errorf("The hook should have received the factory error, got %v", errs)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	clk := newFakeClock()
+	count := 0
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		count++
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithUnlimited(), WithInitialConns(1), WithIdleTimeout(time.Minute), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	if c := p.Capacity(); c != -1 {
+		t.Errorf("The pool capacity was %d but should be -1", c)
+	}
+
+	// Get never blocks, creating new clients when none is idle
+	var clients []*ClientConn
+	for i := 0; i < 5; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		clients = append(clients, c)
+	}
+	if count != 5 {
+		t.Errorf("The factory was called %d times but should be 5", count)
+	}
+	for _, c := range clients {
+		if err := c.Close(); err != nil {
+			t.Errorf("Close returned an error: %s", err.Error())
+		}
+	}
+	if a := p.Available(); a != 5 {
+		t.Errorf("The pool available was %d but should be 5", a)
+	}
+
+	// The idle clients are reused, then reaped once idle for too long
+	c, _ := p.Get(context.Background())
+	if count != 5 {
+		t.Errorf("The idle client should have been reused")
+	}
+	clk.Advance(2 * time.Minute)
+	p.reap()
+	if a := p.Available(); a != 0 {
+		t.Errorf("The pool available was %d but should be 0", a)
+	}
+	c.Close()
+	if o := p.Stats().Open; o != 1 {
+		t.Errorf("The pool had %d open connections but should have 1", o)
+	}
+}
+
+func TestReapInterval(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(2), WithCapacity(2), WithIdleTimeout(time.Millisecond),
+		WithReapInterval(5*time.Millisecond))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if o := p.Stats().Open; o != 0 {
+		t.Errorf("The pool had %d open connections but should have 0", o)
+	}
+	if a := p.Available(); a != 2 {
+		t.Errorf("The pool available was %d but should be 2", a)
+	}
+	p.Close()
+}
+
+func TestIsFresh(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 2, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c1, _ := p.Get(context.Background())
+	c2, _ := p.Get(context.Background())
+	if c1.IsFresh() {
+		t.Errorf("The initial connection shouldn't be fresh")
+	}
+	if !c2.IsFresh() {
+		t.Errorf("The connection created by Get should be fresh")
+	}
+	c2.Close()
+	c1.Close()
+
+	c2, _ = p.Get(context.Background())
+	if c2.IsFresh() {
+		t.Errorf("The reused connection shouldn't be fresh")
+	}
+}
+
+func TestGetN(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 3, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	if _, err := p.GetN(context.Background(), 4); err != ErrTooManyClients {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTooManyClients, err)
+	}
+
+	conns, err := p.GetN(context.Background(), 3)
+	if err != nil {
+		t.Errorf("GetN returned an error: %s", err.Error())
+	}
+	if len(conns) != 3 {
+		t.Errorf("GetN returned %d clients but should have returned 3", len(conns))
+	}
+	seen := make(map[*grpc.ClientConn]bool)
+	for _, c := range conns {
+		if seen[c.ClientConn] {
+			t.Errorf("GetN returned the same client twice")
+		}
+		seen[c.ClientConn] = true
+	}
+	if a := p.Available(); a != 0 {
+		t.Errorf("The pool available was %d but should be 0", a)
+	}
+	for _, c := range conns[1:] {
+		c.Close()
+	}
+
+	// With one client still checked out, the batch can only be partial: the
+	// acquired clients are given back
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetN(ctx, 3); err != ErrTimeout {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+	if a := p.Available(); a != 2 {
+		t.Errorf("The pool available was %d but should be 2", a)
+	}
+
+	conns[0].Close()
+	conns, err = p.GetN(context.Background(), 3)
+	if err != nil {
+		t.Errorf("GetN returned an error: %s", err.Error())
+	}
+	if len(conns) != 3 {
+		t.Errorf("GetN returned %d clients but should have returned 3", len(conns))
+	}
+}
+
+func TestUnhealthyNotHandedOut(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 2, 2, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	bad := c.ClientConn
+	c.Unhealthy()
+
+	// The flagged client is checked out, so it can't be handed to anyone
+	// else before its holder gives it back
+	other, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if other.ClientConn == bad {
+		t.Errorf("Get handed out the unhealthy client")
+	}
+	other.Close()
+
+	// And giving it back closes it rather than queuing it
+	c.Close()
+	if bad.GetState() != connectivity.Shutdown {
+		t.Errorf("The unhealthy client should have been closed")
+	}
+	for i := 0; i < 2; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		if c.ClientConn == bad {
+			t.Errorf("Get handed out the unhealthy client")
+		}
+		defer c.Close()
+	}
+}
+
+func TestFactoryIgnoringContext(t *testing.T) {
+	release := make(chan struct{})
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		<-release
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	// The factory blocks regardless of ctx, Get gives up on its own
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = p.Get(ctx)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error \"%s: %s\" but got \"%v\"", ErrTimeout, context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Get returned after %s, it should have honored the context", d)
+	}
+
+	// The connection created afterward is kept as an idle client
+	close(release)
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if c.IsFresh() {
+		t.Errorf("Get should have handed out the connection of the abandoned dial")
+	}
+	if n := len(p.Inspect()); n != 1 {
+		t.Errorf("The pool held %d connections but should hold 1", n)
+	}
+	c.Close()
+}
+
+func TestWaitStats(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	// A checkout served right away doesn't count as a wait
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if s := p.Stats(); s.TotalWaitNanos != 0 || s.WaitHistogram != [4]int64{} {
+		t.Errorf("No wait should have been recorded but got %+v", s)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.Close()
+	}()
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	defer c.Close()
+
+	s := p.Stats()
+	if s.TotalWaitNanos < int64(20*time.Millisecond) {
+		t.Errorf("The total wait was %d but should be at least %d", s.TotalWaitNanos, 20*time.Millisecond)
+	}
+	if s.WaitHistogram[2]+s.WaitHistogram[3] != 1 || s.WaitHistogram[0]+s.WaitHistogram[1] != 0 {
+		t.Errorf("The wait histogram was %v but should hold a single wait over 10ms", s.WaitHistogram)
+	}
+}
+
+func TestDialConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(16), WithDialConcurrency(2))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := p.Get(context.Background())
+			if err != nil {
+				t.Errorf("Get returned an error: %s", err.Error())
+				return
+			}
+			defer c.Close()
+			time.Sleep(50 * time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&maxInFlight); max != 2 {
+		t.Errorf("The concurrent factory calls peaked at %d but should be 2", max)
+	}
+
+	// A Get canceled while waiting for a dial slot doesn't keep it
+	block := make(chan struct{})
+	p.SetFactory(func(ctx context.Context) (*grpc.ClientConn, error) {
+		<-block
+		return nil, errors.New("factory error")
+	})
+	p.Reset()
+	for i := 0; i < 2; i++ {
+		go p.Get(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+	close(block)
+	for i := 0; i < 100 && p.Available() != 16; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if a := p.Available(); a != 16 {
+		t.Errorf("The pool available was %d but should be 16", a)
+	}
+}
+
+func TestDialConcurrencyCanceled(t *testing.T) {
+	var calls int32
+	block := make(chan struct{})
+	defer close(block)
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		// The first two calls ignore their context
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			<-block
+			return nil, errors.New("factory error")
+		}
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(4), WithDialConcurrency(2))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if _, err := p.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected error \"%s\" but got \"%v\"", context.DeadlineExceeded, err)
+		}
+		cancel()
+	}
+
+	// The canceled Get freed their slots although their factory calls
+	// are still running
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	c.Close()
+}
+
+func TestTryGet(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(2), WithInitialConns(1))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+	events := p.Events()
+
+	// The idle client, then a new one
+	var clients []*ClientConn
+	for i := 0; i < 2; i++ {
+		c, err := p.TryGet()
+		if err != nil {
+			t.Fatalf("TryGet returned an error: %s", err.Error())
+		}
+		clients = append(clients, c)
+	}
+
+	start := time.Now()
+	if _, err := p.TryGet(); err != ErrNoneAvailable {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrNoneAvailable, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("TryGet returned after %s, it shouldn't have waited", d)
+	}
+	for len(events) > 0 {
+		if e := <-events; e.Kind == GetBlocked {
+			t.Errorf("TryGet shouldn't have blocked")
+		}
+	}
+
+	clients[0].Close()
+	c, err := p.TryGet()
+	if err != nil {
+		t.Fatalf("TryGet returned an error: %s", err.Error())
+	}
+	c.Close()
+	clients[1].Close()
+
+	// A dial ignoring its context doesn't block TryGet either
+	block := make(chan struct{})
+	defer close(block)
+	p, err = NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		<-block
+		return nil, errors.New("factory error")
+	}, WithCapacity(1), WithDialTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+	start = time.Now()
+	if _, err := p.TryGet(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("TryGet returned after %s, it should have given up the dial", d)
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithGetTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+	if c := p.Config(); c.GetTimeout != 10*time.Millisecond {
+		t.Errorf("The pool get timeout was %s but should be 10ms", c.GetTimeout)
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	defer c.Close()
+
+	// The exhausted pool doesn't hang a Get without deadline
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Get(context.Background())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrTimeout {
+			t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get should have given up after the get timeout")
+	}
+
+	// So do the other checkout methods, whatever they wait for
+	c.Close()
+	p.Pause()
+	p.partitions = map[string]chan struct{}{"full": make(chan struct{})}
+	checkouts := map[string]func() error{
+		"GetForKey": func() error {
+			_, err := p.GetForKey(context.Background(), "session")
+			return err
+		},
+		"GetForPartition": func() error {
+			_, err := p.GetForPartition(context.Background(), "full")
+			return err
+		},
+		"GetN": func() error {
+			_, err := p.GetN(context.Background(), 1)
+			return err
+		},
+	}
+	for name, checkout := range checkouts {
+		go func() {
+			done <- checkout()
+		}()
+		select {
+		case err := <-done:
+			if err != ErrTimeout {
+				t.Errorf("%s: Expected error \"%s\" but got \"%v\"", name, ErrTimeout, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s should have given up after the get timeout", name)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	factoryFor := func(target string) FactoryWithContext {
+		return func(ctx context.Context) (*grpc.ClientConn, error) {
+			return grpc.Dial(target, grpc.WithInsecure())
+		}
+	}
+	p, err := NewWithOptions(context.Background(), factoryFor("blue.example.com"),
+		WithCapacity(2), WithInitialConns(1), WithCheckoutOrder(LIFO), WithName("billing"))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	// The settings changed since carry over
+	p.SetFactory(factoryFor("green.example.com"))
+	p.SetIdleTimeout(time.Minute)
+	if err := p.Resize(context.Background(), 3); err != nil {
+		t.Fatalf("Resize returned an error: %s", err.Error())
+	}
+
+	clone, err := p.Clone(context.Background())
+	if err != nil {
+		t.Fatalf("Clone returned an error: %s", err.Error())
+	}
+	defer clone.Close()
+	c := clone.Config()
+	if c.Capacity != 3 || c.InitialConns != 1 || c.IdleTimeout != time.Minute || c.CheckoutOrder != LIFO {
+		t.Errorf("The clone config was %+v", c)
+	}
+	if infos := clone.Inspect(); len(infos) != 1 || infos[0].Target != "green.example.com" {
+		t.Errorf("The clone should have dialed the new factory: %+v", infos)
+	}
+	if len(p.Inspect()) != 1 {
+		t.Error("The clone should have created its own connections")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(4), WithInitialConns(8), WithIdleTimeout(time.Minute),
+		WithCheckoutOrder(LIFO), WithDialConcurrency(2), WithName("billing"), WithMaxIdle(2),
+		WithPartitions(map[string]int{"noisy": 1, "quiet": 0}), WithPauseBehavior(PauseFail))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	expected := PoolConfig{
+		Name:            "billing",
+		Capacity:        4,
+		InitialConns:    4,
+		IdleTimeout:     time.Minute,
+		CheckoutOrder:   LIFO,
+		DialConcurrency: 2,
+		MinInitialConns: -1,
+		MaxIdle:         2,
+		PauseBehavior:   PauseFail,
+		Partitions:      map[string]int{"noisy": 1, "quiet": 0},
+	}
+	if c := p.Config(); !reflect.DeepEqual(c, expected) {
+		t.Errorf("The config was %+v but should be %+v", c, expected)
+	}
+}
+
+func TestInUse(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 3, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	var conns []*ClientConn
+	for i := 1; i <= 3; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		conns = append(conns, c)
+		if n := p.InUse(); n != i {
+			t.Errorf("The pool in use was %d but should be %d", n, i)
+		}
+		if a := p.Available(); a != 3-i {
+			t.Errorf("The pool available was %d but should be %d", a, 3-i)
+		}
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	if n := p.InUse(); n != 0 {
+		t.Errorf("The pool in use was %d but should be 0", n)
+	}
+
+	p.Close()
+	if n := p.InUse(); n != 0 {
+		t.Errorf("The pool in use was %d but should be 0", n)
+	}
+}
+
+func TestPut(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return nil, errors.New("the pool shouldn't dial")
+	}, 0, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	cc, err := grpc.Dial("example.com", grpc.WithInsecure())
+	if err != nil {
+		t.Errorf("Dial returned an error: %s", err.Error())
+	}
+	if err := p.Put(cc); err != nil {
+		t.Errorf("Put returned an error: %s", err.Error())
+	}
+
+	// The pool is full now
+	other, err := grpc.Dial("example.com", grpc.WithInsecure())
+	if err != nil {
+		t.Errorf("Dial returned an error: %s", err.Error())
+	}
+	defer other.Close()
+	if err := p.Put(other); err != ErrFullPool {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrFullPool, err)
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if c.ClientConn != cc {
+		t.Errorf("Get should have handed out the connection given to Put")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+
+	p.Close()
+	if cc.GetState() != connectivity.Shutdown {
+		t.Errorf("Closing the pool should have closed the connection given to Put")
+	}
+	if err := p.Put(other); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+}
+
+func TestMaxLifeIdle(t *testing.T) {
+	clk := newFakeClock()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(2), WithCapacity(2), WithMaxLife(time.Hour), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	// Get doesn't hand out an idle connection past its max life
+	clk.Advance(2 * time.Hour)
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if !c.IsFresh() {
+		t.Errorf("Get should have recycled the expired connection")
+	}
+
+	// And the reaper closes the other one without waiting for Get
+	p.reap()
+	if o := p.Stats().Open; o != 1 {
+		t.Errorf("The pool had %d open connections but should have 1", o)
+	}
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+	c.Close()
+}
+
+func TestConnSelector(t *testing.T) {
+	var candidates int32
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(2), WithCapacity(3), WithConnSelector(func(c []*ClientConn) int {
+		atomic.StoreInt32(&candidates, int32(len(c)))
+		// Pick a placeholder over the existing connections
+		for i := range c {
+			if c[i].ClientConn == nil {
+				return i
+			}
+		}
+		return -1
+	}))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if n := atomic.LoadInt32(&candidates); n != 3 {
+		t.Errorf("The selector was given %d candidates but should have 3", n)
+	}
+	if !c.IsFresh() {
+		t.Errorf("The selector should have picked the placeholder")
+	}
+
+	// Without a placeholder left, the index is out of range and the
+	// checkout order applies
+	c2, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if c2.IsFresh() {
+		t.Errorf("Get should have handed out an existing connection")
+	}
+	c2.Close()
+	c.Close()
+}
+
+func TestElasticCapacity(t *testing.T) {
+	clk := newFakeClock()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(1), WithCapacity(100), WithElasticCapacity(),
+		WithIdleTimeout(time.Minute), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	if c := cap(p.getClients().items); c > 1 {
+		t.Errorf("The pool allocated %d clients but should allocate at most 1", c)
+	}
+	if a := p.Available(); a != 100 {
+		t.Errorf("The pool available was %d but should be 100", a)
+	}
+
+	// The initial connection is handed out before creating new ones
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if c.IsFresh() {
+		t.Errorf("Get should have handed out the initial connection")
+	}
+	conns := []*ClientConn{c}
+	for i := 0; i < 63; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	if a := p.Available(); a != 100 {
+		t.Errorf("The pool available was %d but should be 100", a)
+	}
+
+	// Reaping the idle connections releases their memory
+	clk.Advance(2 * time.Minute)
+	p.reap()
+	if c := cap(p.getClients().items); c >= 16 {
+		t.Errorf("The pool kept %d clients allocated but should have shrunk", c)
+	}
+	if a := p.Available(); a != 100 {
+		t.Errorf("The pool available was %d but should be 100", a)
+	}
+	if o := p.Stats().Open; o != 0 {
+		t.Errorf("The pool had %d open connections but should have 0", o)
+	}
+}
+
+func TestAvailableECapacityE(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 3, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	if c, err := p.CapacityE(); c != 3 || err != nil {
+		t.Errorf("CapacityE returned (%d, %v) but should return (3, nil)", c, err)
+	}
+	if a, err := p.AvailableE(); a != 3 || err != nil {
+		t.Errorf("AvailableE returned (%d, %v) but should return (3, nil)", a, err)
+	}
+
+	p.Close()
+	if _, err := p.CapacityE(); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+	if _, err := p.AvailableE(); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+}
+
+func TestConcurrentAccounting(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 2, 4, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c, err := p.Get(context.Background())
+				if err != nil {
+					t.Errorf("Get returned an error: %s", err.Error())
+					return
+				}
+				if n := p.InUse(); n < 1 || n > 4 {
+					t.Errorf("The pool in use was %d but should be between 1 and 4", n)
+				}
+				c.Close()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 200; j++ {
+			s := p.Stats()
+			if s.InUse < 0 || s.InUse > s.Open {
+				t.Errorf("The stats were inconsistent: %+v", s)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if n := p.InUse(); n != 0 {
+		t.Errorf("The pool in use was %d but should be 0", n)
+	}
+}
+
+func TestWaitClosed(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 2, 3, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	d, err := p.GetDedicated(context.Background())
+	if err != nil {
+		t.Errorf("GetDedicated returned an error: %s", err.Error())
+	}
+	p.Close()
+
+	// The checked out connections are still open
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.WaitClosed(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", context.DeadlineExceeded, err)
+	}
+
+	cc := c.ClientConn
+	if err := c.Close(); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+	if cc.GetState() != connectivity.Shutdown {
+		t.Errorf("Close should have closed the connection of the closed pool")
+	}
+	if err := d.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.WaitClosed(ctx); err != nil {
+		t.Errorf("WaitClosed returned an error: %s", err.Error())
+	}
+}
+
+func TestClientConnState(t *testing.T) {
+	addr := newTestServer(t)
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial(addr, grpc.WithInsecure())
+	}, 1, 1, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.WaitUntilReady(ctx); err != nil {
+		t.Errorf("WaitUntilReady returned an error: %s", err.Error())
+	}
+	if s := c.State(); s != connectivity.Ready {
+		t.Errorf("The connection state was %s but should be READY", s)
+	}
+	if target := c.Target(); target != addr {
+		t.Errorf("The connection target was %q but should be %q", target, addr)
+	}
+
+	c.Close()
+	if s := c.State(); s != connectivity.Shutdown {
+		t.Errorf("The connection state was %s but should be SHUTDOWN", s)
+	}
+	if target := c.Target(); target != "" {
+		t.Errorf("The connection target was %q but should be empty", target)
+	}
+	var nilConn *ClientConn
+	if target := nilConn.Target(); target != "" {
+		t.Errorf("The connection target was %q but should be empty", target)
+	}
+	if err := c.WaitUntilReady(ctx); !errors.Is(err, ErrNotReady) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrNotReady, err)
+	}
+}
+
+func TestFailFastWhenUnhealthy(t *testing.T) {
+	clk := newFakeClock()
+	var fail int32 = 1
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, errors.New("backend down")
+		}
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(2), WithFailFastWhenUnhealthy(), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get(context.Background()); err == nil || err == ErrAllUnhealthy {
+			t.Errorf("Get should have returned the factory error but got %v", err)
+		}
+	}
+	if _, err := p.Get(context.Background()); err != ErrAllUnhealthy {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrAllUnhealthy, err)
+	}
+
+	// Get tries again once the backend had time to recover
+	atomic.StoreInt32(&fail, 0)
+	clk.Advance(time.Second)
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	c.Close()
+	if _, err := p.Get(context.Background()); err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+}
+
+func TestGetContext(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithContextEnricher(func(base context.Context, c *ClientConn) context.Context {
+		return metadata.AppendToOutgoingContext(base, "x-target", c.Target())
+	}))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c, rpcCtx, err := p.GetContext(ctx)
+	if err != nil {
+		t.Errorf("GetContext returned an error: %s", err.Error())
+	}
+	defer c.Close()
+
+	md, _ := metadata.FromOutgoingContext(rpcCtx)
+	if v := md.Get("x-target"); len(v) != 1 || v[0] != "example.com" {
+		t.Errorf("The context metadata was %v but should hold the target", md)
+	}
+	deadline, _ := ctx.Deadline()
+	if d, ok := rpcCtx.Deadline(); !ok || !d.Equal(deadline) {
+		t.Errorf("The enriched context should keep the deadline")
+	}
+}
+
+func TestCloseContext(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 3, 3, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	conns := p.Inspect()
+	if err := p.CloseContext(context.Background()); err != nil {
+		t.Errorf("CloseContext returned an error: %s", err.Error())
+	}
+	if !p.IsClosed() {
+		t.Errorf("The pool should be closed")
+	}
+	if len(conns) != 3 {
+		t.Errorf("The pool held %d connections but should hold 3", len(conns))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.WaitClosed(ctx); err != nil {
+		t.Errorf("WaitClosed returned an error: %s", err.Error())
+	}
+	if err := p.CloseContext(context.Background()); err != nil {
+		t.Errorf("CloseContext returned an error: %s", err.Error())
+	}
+
+	// An expired context doesn't prevent the pool from closing
+	p, err = New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 3, 3, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	p.CloseContext(ctx)
+	if !p.IsClosed() {
+		t.Errorf("The pool should be closed")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.WaitClosed(ctx); err != nil {
+		t.Errorf("WaitClosed returned an error: %s", err.Error())
+	}
+}
+
+func TestIdleTimeoutLongHeld(t *testing.T) {
+	clk := newFakeClock()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(1), WithCapacity(1), WithIdleTimeout(time.Minute), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	cc := c.ClientConn
+
+	// The client is busy for much longer than the idle timeout: it's out of
+	// the queue, so the idle recycling can't reach it
+	clk.Advance(time.Hour)
+	p.reap()
+	if cc.GetState() == connectivity.Shutdown {
+		t.Errorf("The idle recycling closed a checked out connection")
+	}
+
+	// Giving it back starts its idle time over
+	c.Close()
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if c.ClientConn != cc {
+		t.Errorf("Get should have handed out the connection that was just used")
+	}
+	c.Close()
+}
+
+func TestMaxIdle(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(3), WithMaxIdle(1))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	var conns []*ClientConn
+	for i := 0; i < 3; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		conns = append(conns, c)
+	}
+
+	// The first client given back is kept idle, the others are closed
+	for i, c := range conns {
+		cc := c.ClientConn
+		if err := c.Close(); err != nil {
+			t.Errorf("Close returned an error: %s", err.Error())
+		}
+		if closed := cc.GetState() == connectivity.Shutdown; closed != (i > 0) {
+			t.Errorf("The connection %d closed state was %t but should be %t", i, closed, i > 0)
+		}
+	}
+	if o := p.Stats().Open; o != 1 {
+		t.Errorf("The pool had %d open connections but should have 1", o)
+	}
+	if a := p.Available(); a != 3 {
+		t.Errorf("The pool available was %d but should be 3", a)
+	}
+}
+
+func TestRecycleStats(t *testing.T) {
+	clk := newFakeClock()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(2), WithCapacity(2), WithIdleTimeout(time.Minute),
+		WithMaxLife(time.Hour), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	// Idle recycling of both initial connections, one per Get
+	clk.Advance(2 * time.Minute)
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	// Unhealthy recycling
+	c.Unhealthy()
+	c.Close()
+	// Max life recycling
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	clk.Advance(2 * time.Hour)
+	c.Close()
+	// Reset recycling of the remaining connection
+	c, err = p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	c.Close()
+	p.Reset()
+
+	s := p.Stats()
+	if s.RecycledIdle != 2 {
+		t.Errorf("The idle recycled count was %d but should be 2", s.RecycledIdle)
+	}
+	if s.RecycledUnhealthy != 1 {
+		t.Errorf("The unhealthy recycled count was %d but should be 1", s.RecycledUnhealthy)
+	}
+	if s.RecycledMaxLife != 1 {
+		t.Errorf("The max life recycled count was %d but should be 1", s.RecycledMaxLife)
+	}
+	if s.RecycledReset != 1 {
+		t.Errorf("The reset recycled count was %d but should be 1", s.RecycledReset)
+	}
+	if s.Open != 0 {
+		t.Errorf("The pool had %d open connections but should have 0", s.Open)
+	}
+}
+
+func TestMaxLifeJitter(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(8), WithCapacity(8), WithMaxLife(time.Hour), WithMaxLifeJitter(0.1))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	lives := make(map[time.Duration]bool)
+	for i := 0; i < 8; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		defer c.Close()
+		if c.maxLife < 54*time.Minute || c.maxLife > 66*time.Minute {
+			t.Errorf("The max life was %s but should be within 10%% of 1h", c.maxLife)
+		}
+		lives[c.maxLife] = true
+	}
+	if len(lives) < 2 {
+		t.Errorf("The max lives should differ between the connections")
+	}
+}
+
+func TestPause(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 1, 2, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	p.Pause()
+	if !p.IsPaused() {
+		t.Errorf("The pool should be paused")
+	}
+
+	// Clients can still be given back while paused
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); err != ErrTimeout {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+
+	got := make(chan error)
+	go func() {
+		c, err := p.Get(context.Background())
+		if err == nil {
+			c.Close()
+		}
+		got <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Resume()
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Get should have returned once the pool was resumed")
+	}
+
+	// Closing the pool wakes up the paused Get calls
+	p.Pause()
+	go func() {
+		_, err := p.Get(context.Background())
+		got <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Close()
+	select {
+	case err := <-got:
+		if err != ErrClosed {
+			t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Get should have returned once the pool was closed")
+	}
+}
+
+func TestPauseFail(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithPauseBehavior(PauseFail))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	p.Pause()
+	if _, err := p.Get(context.Background()); err != ErrPaused {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrPaused, err)
+	}
+	p.Resume()
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	c.Close()
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	var dials int32
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		atomic.AddInt32(&dials, 1)
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithMaxRequestsPerConn(3))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	for i := 0; i < 4; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		if fresh := c.IsFresh(); fresh != (i%3 == 0) {
+			t.Errorf("The checkout %d fresh state was %t but should be %t", i, fresh, i%3 == 0)
+		}
+		c.Close()
+	}
+	if d := atomic.LoadInt32(&dials); d != 2 {
+		t.Errorf("The factory was called %d times but should have been called 2 times", d)
+	}
+	if r := p.Stats().RecycledMaxRequests; r != 1 {
+		t.Errorf("The max requests recycled count was %d but should be 1", r)
+	}
+}
+
+func TestDialLatency(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		time.Sleep(10 * time.Millisecond)
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(1), WithCapacity(2))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	c1, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	defer c1.Close()
+	c2, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	defer c2.Close()
+	for _, c := range []*ClientConn{c1, c2} {
+		if l := c.DialLatency(); l < 10*time.Millisecond {
+			t.Errorf("The dial latency was %s but should be at least 10ms", l)
+		}
+	}
+
+	s := p.Stats()
+	if s.Dials != 2 {
+		t.Errorf("The pool dialed %d times but should have dialed 2 times", s.Dials)
+	}
+	if s.TotalDialNanos < int64(20*time.Millisecond) || s.MaxDialNanos < int64(10*time.Millisecond) {
+		t.Errorf("The dial stats were inconsistent: %+v", s)
+	}
+}
+
+func TestInit(t *testing.T) {
+	factory := func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}
+
+	var p Pool
+	if _, err := p.Get(context.Background()); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+	if err := p.Init(WithFactory(factory), WithInitialConns(1), WithCapacity(2)); err != nil {
+		t.Errorf("Init returned an error: %s", err.Error())
+	}
+	defer p.Close()
+	if err := p.Init(WithFactory(factory)); err != ErrInitialized {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrInitialized, err)
+	}
+	if a := p.Capacity(); a != 2 {
+		t.Errorf("The pool capacity was %d but should be 2", a)
+	}
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	c.Close()
+
+	// Get initializes the pool from the factory set with SetFactory
+	var lazy Pool
+	lazy.SetFactory(factory)
+	c, err = lazy.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if a := lazy.Capacity(); a != 1 {
+		t.Errorf("The pool capacity was %d but should be 1", a)
+	}
+	c.Close()
+	lazy.Close()
+	if _, err := lazy.Get(context.Background()); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+
+	// So do the other methods checking out clients and Put
+	checkouts := map[string]func(p *Pool) error{
+		"GetForKey": func(p *Pool) error {
+			c, err := p.GetForKey(context.Background(), "session")
+			if err == nil {
+				c.Close()
+			}
+			return err
+		},
+		"GetN": func(p *Pool) error {
+			conns, err := p.GetN(context.Background(), 1)
+			for _, c := range conns {
+				c.Close()
+			}
+			return err
+		},
+		"GetDedicated": func(p *Pool) error {
+			c, err := p.GetDedicated(context.Background())
+			if err == nil {
+				c.Close()
+			}
+			return err
+		},
+		"Put": func(p *Pool) error {
+			cc, err := factory(context.Background())
+			if err != nil {
+				return err
+			}
+			return p.Put(cc)
+		},
+	}
+	for name, checkout := range checkouts {
+		var lazy Pool
+		lazy.SetFactory(factory)
+		if err := checkout(&lazy); err != nil {
+			t.Errorf("%s returned an error: %s", name, err.Error())
+		}
+		if lazy.IsClosed() {
+			t.Errorf("%s should have initialized the pool", name)
+		}
+		lazy.Close()
+	}
+
+	// A pool closed before being initialized stays closed
+	var closed Pool
+	closed.Close()
+	closed.SetFactory(factory)
+	if _, err := closed.Get(context.Background()); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+	if err := closed.Init(); err != ErrInitialized {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrInitialized, err)
+	}
+
+	var none Pool
+	if err := none.Init(); err != ErrNoFactory {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrNoFactory, err)
+	}
+}
+
+func TestCloseUnhealthyAfterPoolClose(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithInitialConns(1), WithCapacity(1))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	c.Unhealthy()
+	cc := c.ClientConn
+	p.Close()
+	if err := c.Close(); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+	if s := cc.GetState(); s != connectivity.Shutdown {
+		t.Errorf("The connection state was %s but should be %s", s, connectivity.Shutdown)
+	}
+
+	// Another path reaching the same connection must not close it again
+	p.destroy(cc, recycleUnhealthy)
+	if n := p.recycled[recycleDiscarded] + p.recycled[recycleUnhealthy]; n != 1 {
+		t.Errorf("The connection was closed %d times but should be closed once", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.WaitClosed(ctx); err != nil {
+		t.Errorf("WaitClosed returned an error: %s", err.Error())
+	}
+	if p.live != 0 {
+		t.Errorf("The pool had %d live connections but should have 0", p.live)
+	}
+}
+
+func TestUnhealthyPending(t *testing.T) {
+	p, err := New(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, 2, 2, 0)
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	c1, _ := p.Get(context.Background())
+	c2, _ := p.Get(context.Background())
+	c1.Unhealthy()
+	if n := p.UnhealthyPending(); n != 1 {
+		t.Errorf("The pool unhealthy pending was %d but should be 1", n)
+	}
+	if n := p.Stats().UnhealthyPending; n != 1 {
+		t.Errorf("The stats unhealthy pending was %d but should be 1", n)
+	}
+	c1.Close()
+	c2.Close()
+	if n := p.UnhealthyPending(); n != 0 {
+		t.Errorf("The pool unhealthy pending was %d but should be 0", n)
+	}
+}
+
+func TestWithName(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithName("billing"))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	c.Close()
+	err = c.Close()
+	var poolErr *PoolError
+	if !errors.As(err, &poolErr) || poolErr.Pool != "billing" || !errors.Is(err, ErrAlreadyClosed) {
+		t.Errorf("Expected a PoolError of billing wrapping \"%s\" but got \"%v\"", ErrAlreadyClosed, err)
+	}
+
+	p.Close()
+	_, err = p.Get(context.Background())
+	if !errors.As(err, &poolErr) || poolErr.Pool != "billing" || !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected a PoolError of billing wrapping \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+}
+
+func BenchmarkGetClose(b *testing.B) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithInitialConns(1))
+	if err != nil {
+		b.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := p.Get(ctx)
+		if err != nil {
+			b.Fatalf("Get returned an error: %s", err.Error())
+		}
+		if err := c.Close(); err != nil {
+			b.Fatalf("Close returned an error: %s", err.Error())
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	addr := newTestServer(t)
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial(addr, grpc.WithInsecure())
+	}, WithCapacity(2))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	if p.Ready() {
+		t.Error("A pool without connections should not be ready")
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Ready() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !p.Ready() {
+		t.Error("The pool should be ready")
+	}
+
+	p.Close()
+	if p.Ready() {
+		t.Error("A closed pool should not be ready")
+	}
+}
+
+func TestReturnToFront(t *testing.T) {
+	for _, front := range []bool{false, true} {
+		opts := []Option{WithCapacity(3), WithInitialConns(3)}
+		if front {
+			opts = append(opts, WithReturnToFront())
+		}
+		p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+			return grpc.Dial("example.com", grpc.WithInsecure())
+		}, opts...)
+		if err != nil {
+			t.Errorf("The pool returned an error: %s", err.Error())
+		}
+
+		used := map[*grpc.ClientConn]bool{}
+		for i := 0; i < 6; i++ {
+			c, err := p.Get(context.Background())
+			if err != nil {
+				t.Errorf("Get returned an error: %s", err.Error())
+			}
+			used[c.ClientConn] = true
+			c.Close()
+		}
+		want := 3
+		if front {
+			want = 1
+		}
+		if len(used) != want {
+			t.Errorf("The pool used %d connections but should have used %d", len(used), want)
+		}
+
+		c1, _ := p.Get(context.Background())
+		c2, _ := p.Get(context.Background())
+		cc1, cc2 := c1.ClientConn, c2.ClientConn
+		c1.Close()
+		c2.Close()
+		c, _ := p.Get(context.Background())
+		if front && c.ClientConn != cc2 {
+			t.Error("Get should have handed out the last client given back")
+		}
+		if !front && (c.ClientConn == cc1 || c.ClientConn == cc2) {
+			t.Error("Get should have handed out the client idle the longest")
+		}
+		c.Close()
+		p.Close()
+	}
+}
+
+func TestIdleTimeoutDeepInQueue(t *testing.T) {
+	clk := newFakeClock()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(3), WithInitialConns(3), WithIdleTimeout(time.Minute), WithReturnToFront(), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	// The same client keeps being handed out and given back, the other two
+	// stay behind it
+	for i := 0; i < 5; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		c.Close()
+		clk.Advance(30 * time.Second)
+	}
+
+	if n := p.Stats().RecycledIdle; n != 2 {
+		t.Errorf("The pool recycled %d idle clients but should have recycled 2", n)
+	}
+	if n := len(p.Inspect()); n != 1 {
+		t.Errorf("The pool held %d connections but should hold 1", n)
+	}
+}
+
+func TestBurst(t *testing.T) {
+	clk := newFakeClock()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithBurst(2, 4, time.Minute), WithInitialConns(2), withClock(clk))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+	if c := p.Capacity(); c != 4 {
+		t.Errorf("The pool capacity was %d but should be 4", c)
+	}
+
+	// The idle connections are handed out before new ones are created
+	c, _ := p.Get(context.Background())
+	c.Close()
+	if n := len(p.Inspect()); n != 2 {
+		t.Errorf("The pool held %d connections but should hold 2", n)
+	}
+
+	var burst []*ClientConn
+	for i := 0; i < 4; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		burst = append(burst, c)
+	}
+	for _, c := range burst[:3] {
+		c.Close()
+	}
+
+	// The extra idle connections are closed, the busy one is kept
+	clk.Advance(2 * time.Minute)
+	p.reap()
+	if n := p.Stats().RecycledBurst; n != 2 {
+		t.Errorf("The pool recycled %d burst connections but should have recycled 2", n)
+	}
+	if n := len(p.Inspect()); n != 2 {
+		t.Errorf("The pool held %d connections but should hold 2", n)
+	}
+	if burst[3].State() == connectivity.Shutdown {
+		t.Error("The checked out connection should not have been closed")
+	}
+	burst[3].Close()
+	clk.Advance(2 * time.Minute)
+	p.reap()
+	if n := len(p.Inspect()); n != 2 {
+		t.Errorf("The pool held %d connections but should hold 2", n)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	fallback, err := grpc.Dial("replica.example.com", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial returned an error: %s", err.Error())
+	}
+	defer fallback.Close()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithFallback(fallback))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	c1, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if c1.IsFallback() {
+		t.Error("The first client should not be the fallback")
+	}
+	for i := 0; i < 2; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		if !c.IsFallback() || c.ClientConn != fallback {
+			t.Error("The saturated pool should have handed out the fallback")
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("Close returned an error: %s", err.Error())
+		}
+	}
+	if s := fallback.GetState(); s == connectivity.Shutdown {
+		t.Error("The fallback connection should not have been closed")
+	}
+	if a := p.Available(); a != 0 {
+		t.Errorf("The pool available was %d but should be 0", a)
+	}
+
+	// GetN and GetForKey need clients of their own, they wait instead
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetN(ctx, 1); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+	if _, err := p.GetForKey(ctx, "key"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+
+	c1.Close()
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+}
+
+func TestMaxLifetimeConnections(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(2), WithInitialConns(1), WithMaxLifetimeConnections(3))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	// Every connection is found broken and recycled, until the budget is
+	// exhausted
+	for i := 0; i < 3; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+			continue
+		}
+		c.Unhealthy()
+		c.Close()
+	}
+	c1, err := p.Get(context.Background())
+	if err != ErrConnectionBudgetExhausted {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrConnectionBudgetExhausted, err)
+	}
+	if c1 != nil {
+		c1.Close()
+	}
+	if n := p.Stats().Dials; n != 3 {
+		t.Errorf("The pool dialed %d times but should have dialed 3 times", n)
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	factory := func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}
+	invalid := map[string][]Option{
+		"zero capacity":     {WithCapacity(0)},
+		"negative capacity": {WithCapacity(-2)},
+		"negative init":     {WithCapacity(2), WithInitialConns(-1)},
+		"init over cap":     {WithCapacity(2), WithInitialConns(3)},
+		"init over default": {WithInitialConns(2)},
+		"negative jitter":   {WithMaxLife(time.Minute), WithMaxLifeJitter(-0.1)},
+		"jitter over 1":     {WithMaxLife(time.Minute), WithMaxLifeJitter(1.5)},
+		"burst over cap":    {WithBurst(5, 4, time.Minute)},
+	}
+	for name, opts := range invalid {
+		_, err := NewWithOptions(context.Background(), factory, append(opts, WithStrictConfig())...)
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: expected error \"%s\" but got \"%v\"", name, ErrInvalidConfig, err)
+		}
+
+		// The options are clamped by default
+		p, err := NewWithOptions(context.Background(), factory, opts...)
+		if err != nil {
+			t.Errorf("%s: the pool returned an error: %s", name, err.Error())
+			continue
+		}
+		p.Close()
+	}
+
+	p, err := NewWithOptions(context.Background(), factory, WithStrictConfig())
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	p.Close()
+	p, err = NewWithOptions(context.Background(), factory, WithStrictConfig(), WithUnlimited(), WithInitialConns(2))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	p.Close()
+}
+
+func TestEvents(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	events := p.Events()
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); err != ErrTimeout {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrTimeout, err)
+	}
+	c.Unhealthy()
+	c.Close()
+	p.Close()
+
+	var kinds []EventKind
+	for len(events) > 0 {
+		e := <-events
+		kinds = append(kinds, e.Kind)
+		if e.Kind == ConnClosed && e.Reason != "unhealthy" {
+			t.Errorf("The connection was closed for %q but should be for \"unhealthy\"", e.Reason)
+		}
+	}
+	want := []EventKind{ConnCreated, GetServed, GetBlocked, ConnUnhealthy, ConnClosed, PoolClosed}
+	if len(kinds) != len(want) {
+		t.Fatalf("The events were %v but should be %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Errorf("The events were %v but should be %v", kinds, want)
+			break
+		}
+	}
+}
+
+func TestEventsDropped(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithInitialConns(1))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	p.Events()
+	for i := 0; i < eventsBuffer+10; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		c.Close()
+	}
+	if n := p.Stats().DroppedEvents; n != 10 {
+		t.Errorf("The pool dropped %d events but should have dropped 10", n)
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	var deadline bool
+	factory := func(ctx context.Context) (*grpc.ClientConn, error) {
+		_, deadline = ctx.Deadline()
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}
+
+	invalid := []Config{
+		{},
+		{Capacity: 2, InitialConns: 3},
+		{Capacity: 2, InitialConns: -1},
+		{Capacity: 2, IdleTimeout: -time.Second},
+		{Capacity: 2, MaxLife: -time.Second},
+		{Capacity: 2, DialTimeout: -time.Second},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewFromConfig(context.Background(), factory, cfg); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%+v: expected error \"%s\" but got \"%v\"", cfg, ErrInvalidConfig, err)
+		}
+	}
+
+	// The durations of a JSON configuration can be strings
+	var decoded Config
+	err := json.Unmarshal([]byte(`{"name": "billing", "capacity": 3, "initial_conns": 1,
+		"idle_timeout": "1m", "max_life": "1h", "dial_timeout": 1000000000}`), &decoded)
+	if err != nil {
+		t.Fatalf("Unmarshal returned an error: %s", err.Error())
+	}
+	expected := Config{
+		Name:         "billing",
+		Capacity:     3,
+		InitialConns: 1,
+		IdleTimeout:  time.Minute,
+		MaxLife:      time.Hour,
+		DialTimeout:  time.Second,
+	}
+	if decoded != expected {
+		t.Errorf("The decoded config was %+v but should be %+v", decoded, expected)
+	}
+	if err := json.Unmarshal([]byte(`{"idle_timeout": "soon"}`), &decoded); err == nil {
+		t.Error("Unmarshal should have failed on an invalid duration")
+	}
+
+	p, err := NewFromConfig(context.Background(), factory, Config{
+		Name:         "billing",
+		Capacity:     3,
+		InitialConns: 1,
+		IdleTimeout:  time.Minute,
+		MaxLife:      time.Hour,
+		DialTimeout:  time.Second,
+	}, WithCheckoutOrder(LIFO))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+	if !deadline {
+		t.Error("The factory context should have had a deadline")
+	}
+	c := p.Config()
+	if c.Capacity != 3 || c.InitialConns != 1 || c.IdleTimeout != time.Minute ||
+		c.MaxLifeDuration != time.Hour || c.CheckoutOrder != LIFO {
+		t.Errorf("The pool config was %+v", c)
+	}
+}
+
+func TestApply(t *testing.T) {
+	clk := newFakeClock()
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(2), WithInitialConns(1), withClock(clk))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	if err := p.Apply(Config{IdleTimeout: -time.Second}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrInvalidConfig, err)
+	}
+	// The capacity is left unchanged when it isn't set
+	err = p.Apply(Config{IdleTimeout: time.Minute, MaxLife: time.Hour, DialTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("Apply returned an error: %s", err.Error())
+	}
+	c := p.Config()
+	if c.Capacity != 2 || c.IdleTimeout != time.Minute || c.MaxLifeDuration != time.Hour ||
+		c.DialTimeout != time.Second {
+		t.Errorf("The pool config was %+v", c)
+	}
+
+	// The initial client is now idle for too long
+	clk.Advance(2 * time.Minute)
+	client, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	client.Close()
+	if r := p.Stats().RecycledIdle; r != 1 {
+		t.Errorf("The pool recycled %d idle clients but should recycle 1", r)
+	}
+
+	// A capacity resizes the pool
+	if err := p.Apply(Config{Capacity: 3}); err != nil {
+		t.Fatalf("Apply returned an error: %s", err.Error())
+	}
+	if c := p.Capacity(); c != 3 {
+		t.Errorf("The pool capacity was %d but should be 3", c)
+	}
+
+	// An unlimited pool only takes the timeouts
+	u, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithUnlimited())
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer u.Close()
+	if err := u.Apply(Config{Capacity: 3, IdleTimeout: time.Minute}); err != nil {
+		t.Errorf("Apply returned an error: %s", err.Error())
+	}
+	if c := u.Config(); c.Capacity != -1 || c.IdleTimeout != time.Minute {
+		t.Errorf("The pool config was %+v", c)
+	}
+}
+
+func TestNewForTarget(t *testing.T) {
+	addr := newTestServer(t)
+	p, err := NewForTarget(context.Background(), addr, []grpc.DialOption{grpc.WithInsecure()},
+		Config{Capacity: 2, InitialConns: 1})
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	defer c.Close()
+	if target := c.Target(); target != addr {
+		t.Errorf("The connection target was %q but should be %q", target, addr)
+	}
+
+	// The dial options of the caller are left untouched
+	spare := []grpc.DialOption{grpc.WithUserAgent("dedicated"), nil}
+	dedicated, err := p.GetDedicated(WithDialOverride(context.Background(), grpc.WithUserAgent("override")),
+		spare[:1]...)
+	if err != nil {
+		t.Fatalf("GetDedicated returned an error: %s", err.Error())
+	}
+	dedicated.Close()
+	if spare[1] != nil {
+		t.Errorf("The factory wrote into the dial options of the caller")
+	}
+
+	if _, err := NewForTarget(context.Background(), addr, nil, Config{}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrInvalidConfig, err)
+	}
+}
+
+func TestEagerConnect(t *testing.T) {
+	addr := newTestServer(t)
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.NewClient(addr, grpc.WithInsecure())
+	}, WithCapacity(2), WithInitialConns(2), WithEagerConnect(5*time.Second))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	for _, info := range p.Inspect() {
+		if info.State != connectivity.Ready {
+			t.Errorf("The connection state was %s but should be READY", info.State)
+		}
+	}
+	p.Close()
+
+	refusing := newRefusingAddress(t)
+	_, err = NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.NewClient(refusing, grpc.WithInsecure())
+	}, WithCapacity(1), WithInitialConns(1), WithEagerConnect(100*time.Millisecond))
+	if !errors.Is(err, ErrNotReady) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrNotReady, err)
+	}
+}
+
+func TestBackgroundWarmup(t *testing.T) {
+	release := make(chan struct{})
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		<-release
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(3), WithInitialConns(2), WithBackgroundWarmup())
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+	if n := len(p.Inspect()); n != 0 {
+		t.Errorf("The pool held %d connections but should hold 0", n)
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.Inspect()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(p.Inspect()); n != 2 {
+		t.Errorf("The pool held %d connections but should hold 2", n)
+	}
+	if a := p.Available(); a != 3 {
+		t.Errorf("The pool available was %d but should be 3", a)
+	}
+}
+
+func TestInitRetry(t *testing.T) {
+	var calls int32
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		// The 2nd, 3rd and 4th dials fail
+		if n := atomic.AddInt32(&calls, 1); n >= 2 && n <= 4 {
+			return nil, errors.New("dial failed")
+		}
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(3), WithInitialConns(3), WithTolerateInitFailures(1),
+		WithInitRetry(time.Millisecond, 4*time.Millisecond))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+	if n := len(p.InitErrors()); n != 2 {
+		t.Errorf("The pool recorded %d init errors but should record 2", n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.Inspect()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(p.Inspect()); n != 3 {
+		t.Errorf("The pool held %d connections but should hold 3", n)
+	}
+	if n := atomic.LoadInt32(&calls); n != 6 {
+		t.Errorf("The factory was called %d times but should be called 6 times", n)
+	}
+	if a := p.Available(); a != 3 {
+		t.Errorf("The pool available was %d but should be 3", a)
+	}
+}
+
+func TestBackgroundWarmupClose(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, WithCapacity(2), WithInitialConns(2), WithBackgroundWarmup())
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.WaitClosed(ctx); err != nil {
+		t.Errorf("WaitClosed returned an error: %s", err.Error())
+	}
+}
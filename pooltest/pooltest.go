@@ -0,0 +1,63 @@
+// Package pooltest provides factories for testing code using grpc pools
+// without any network: their connections are dialed over an in-memory
+// listener to a grpc server without any service.
+package pooltest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	grpcpool "github.com/processout/grpc-go-pool"
+)
+
+// ErrFakeDial is the error of the dials FakeFactory fails
+var ErrFakeDial = errors.New("pooltest: fake dial failure")
+
+const bufferSize = 1024 * 1024
+
+var (
+	serverOnce sync.Once
+	listener   *bufconn.Listener
+)
+
+// Dial creates a connection to the in-memory server, starting it on the first
+// call. It has the signature of a factory
+func Dial(ctx context.Context) (*grpc.ClientConn, error) {
+	serverOnce.Do(func() {
+		listener = bufconn.Listen(bufferSize)
+		go grpc.NewServer().Serve(listener)
+	})
+	return grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithInsecure())
+}
+
+// FakeFactory returns a factory failing its first numToFail calls with
+// ErrFakeDial, and creating in-memory connections afterward
+func FakeFactory(numToFail int) grpcpool.FactoryWithContext {
+	var calls int32
+	return func(ctx context.Context) (*grpc.ClientConn, error) {
+		if int(atomic.AddInt32(&calls, 1)) <= numToFail {
+			return nil, ErrFakeDial
+		}
+		return Dial(ctx)
+	}
+}
+
+// CountingFactory returns a factory creating in-memory connections, along
+// with its number of calls, to be read with atomic.LoadInt32
+func CountingFactory() (grpcpool.FactoryWithContext, *int32) {
+	calls := new(int32)
+	return func(ctx context.Context) (*grpc.ClientConn, error) {
+		atomic.AddInt32(calls, 1)
+		return Dial(ctx)
+	}, calls
+}
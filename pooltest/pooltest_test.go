@@ -0,0 +1,54 @@
+package pooltest
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+
+	grpcpool "github.com/processout/grpc-go-pool"
+)
+
+func TestFakeFactory(t *testing.T) {
+	factory := FakeFactory(2)
+	for i := 0; i < 2; i++ {
+		if _, err := factory(context.Background()); err != ErrFakeDial {
+			t.Errorf("Expected error \"%s\" but got \"%v\"", ErrFakeDial, err)
+		}
+	}
+
+	cc, err := factory(context.Background())
+	if err != nil {
+		t.Fatalf("The factory returned an error: %s", err.Error())
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cc.Connect()
+	for s := cc.GetState(); s != connectivity.Ready; s = cc.GetState() {
+		if !cc.WaitForStateChange(ctx, s) {
+			t.Fatalf("The connection state was %s but should be READY", s)
+		}
+	}
+}
+
+func TestCountingFactory(t *testing.T) {
+	factory, calls := CountingFactory()
+	p, err := grpcpool.NewWithOptions(context.Background(), factory,
+		grpcpool.WithCapacity(2), grpcpool.WithInitialConns(1))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	c1, _ := p.Get(context.Background())
+	c2, _ := p.Get(context.Background())
+	c1.Close()
+	c2.Close()
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("The factory was called %d times but should have been called 2 times", n)
+	}
+}
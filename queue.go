@@ -0,0 +1,619 @@
+package grpcpool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errSurplus is the error when a client given back isn't stored as the queue
+// shrank while it was checked out
+var errSurplus = errors.New("grpc pool: the pool shrank")
+
+// CheckoutOrder is the order in which Get hands out the idle clients
+type CheckoutOrder int
+
+const (
+	// FIFO hands out the least recently returned client first, cycling
+	// through all the clients of the pool
+	FIFO CheckoutOrder = iota
+	// LIFO hands out the most recently returned client first, concentrating
+	// the load on a few clients so the others can time out
+	LIFO
+)
+
+// connQueue stores the idle clients of the pool, including the placeholders
+// of the clients not created yet. The clients are kept in a slice so they can
+// be handed out in any order, while tokens holds one token per stored client
+// so that waiting for one can be done in a select alongside a context.
+// An unlimited queue has no tokens: it never waits and doesn't store any
+// placeholder, a missing client meaning a new one has to be created. An
+// elastic queue only counts its placeholders so that its slice tracks the
+// number of idle connections.
+type connQueue struct {
+	mu        sync.Mutex
+	items     []ClientConn
+	tokens    chan struct{}
+	order     CheckoutOrder
+	closed    bool
+	unlimited bool
+	elastic   bool
+	// empty is the number of placeholders of an elastic queue
+	empty int
+	// returnToFront makes putIdle store the clients where they're the next
+	// to be handed out, see WithReturnToFront
+	returnToFront bool
+	// buf is the backing array of items in a bounded queue, which items is
+	// moved back to the start of instead of growing, see push
+	buf []ClientConn
+	// onLen is called with the queue locked each time its length changes
+	onLen func(int)
+	// selector picks the client to hand out when set, see WithConnSelector
+	selector func([]*ClientConn) int
+	// onSelectorPanic is called with the value recovered from a panic of
+	// selector, with the queue unlocked so that it can use the pool
+	onSelectorPanic func(interface{})
+	// onWait is called with the time get blocked for, measured with clock,
+	// each time get had to wait for a client and got one
+	onWait func(time.Duration)
+	// onBlock is called each time get has to wait for a client
+	onBlock func()
+	clock   clock
+	// resized is closed by resize to wake up the getters waiting on the
+	// previous tokens
+	resized chan struct{}
+	// surplus is the number of clients store drops as the queue shrank
+	// while they were checked out, drained being closed once there is none
+	surplus int
+	drained chan struct{}
+}
+
+// newConnQueue creates a queue storing up to capacity clients, or an
+// unlimited one if capacity is negative
+func newConnQueue(capacity int, order CheckoutOrder, elastic bool) *connQueue {
+	if capacity < 0 {
+		return &connQueue{
+			order:     order,
+			unlimited: true,
+		}
+	}
+	if elastic {
+		return &connQueue{
+			tokens:  make(chan struct{}, capacity),
+			order:   order,
+			elastic: true,
+			resized: make(chan struct{}),
+		}
+	}
+	buf := make([]ClientConn, 0, capacity)
+	return &connQueue{
+		items:   buf,
+		buf:     buf,
+		tokens:  make(chan struct{}, capacity),
+		order:   order,
+		resized: make(chan struct{}),
+	}
+}
+
+// put stores a client, returning ErrFullPool if the queue is already full or
+// ErrClosed if it was closed
+func (q *connQueue) put(c ClientConn) error {
+	_, err := q.store(c, 0, false)
+	return err
+}
+
+// putIdle is like put, but stores a placeholder instead of the client if the
+// queue already holds maxIdle connections, returning true so that the caller
+// closes the connection. A maxIdle of 0 doesn't bound the connections. The
+// client is the next to be handed out if returnToFront is set.
+func (q *connQueue) putIdle(c ClientConn, maxIdle int) (bool, error) {
+	return q.store(c, maxIdle, q.returnToFront)
+}
+
+// store implements put and putIdle, storing the client where it's the next
+// to be handed out if next is set
+func (q *connQueue) store(c ClientConn, maxIdle int, next bool) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false, ErrClosed
+	}
+	if q.surplus > 0 {
+		q.surplus--
+		if q.surplus == 0 && q.drained != nil {
+			close(q.drained)
+			q.drained = nil
+		}
+		return false, errSurplus
+	}
+	evicted := false
+	if maxIdle > 0 && c.ClientConn != nil && q.idle() >= maxIdle {
+		c = ClientConn{
+			pool: c.pool,
+		}
+		evicted = true
+	}
+	next = next && c.ClientConn != nil && q.order == FIFO
+	if q.unlimited {
+		if c.ClientConn != nil {
+			q.push(c)
+			if next {
+				q.toFront()
+			}
+		}
+		return evicted, nil
+	}
+	if q.size() >= cap(q.tokens) {
+		return false, ErrFullPool
+	}
+	if q.elastic && c.ClientConn == nil {
+		q.empty++
+	} else {
+		q.push(c)
+		if next {
+			q.toFront()
+		}
+	}
+	q.tokens <- struct{}{}
+	q.lenChanged()
+	return evicted, nil
+}
+
+// push appends a client to items, the queue must be locked. As pop hands
+// out the first client by reslicing items, items reaches the end of buf while
+// there is room left at its start: it's then moved back to the start of buf,
+// so that a bounded queue never allocates once created
+func (q *connQueue) push(c ClientConn) {
+	if len(q.items) == cap(q.items) && len(q.items) < cap(q.buf) {
+		n := copy(q.buf[:len(q.items)], q.items)
+		stale := q.buf[n:cap(q.buf)]
+		for i := range stale {
+			stale[i] = ClientConn{}
+		}
+		q.items = q.buf[:n]
+	}
+	q.items = append(q.items, c)
+}
+
+// toFront moves the last client of items to the front, the queue must be
+// locked. A bounded queue uses the room left at the start of buf if any
+func (q *connQueue) toFront() {
+	last := len(q.items) - 1
+	c := q.items[last]
+	q.items[last] = ClientConn{}
+	if start := cap(q.buf) - cap(q.items); q.buf != nil && start > 0 {
+		q.items = q.buf[start-1 : start+last]
+	} else {
+		copy(q.items[1:], q.items[:last])
+	}
+	q.items[0] = c
+}
+
+// idle returns the number of stored connections, placeholders excluded. The
+// queue must be locked
+func (q *connQueue) idle() int {
+	if q.unlimited || q.elastic {
+		return len(q.items)
+	}
+	n := 0
+	for _, c := range q.items {
+		if c.ClientConn != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// get waits for a client and removes it from the queue. It returns
+// ErrTimeout if ctx is done or wait fires first, and ErrClosed if the queue
+// gets closed. A nil wait never fires. An unlimited queue returns a
+// placeholder right away if it's empty.
+func (q *connQueue) get(ctx context.Context, wait <-chan time.Time) (ClientConn, error) {
+	if q.unlimited {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return ClientConn{}, ErrClosed
+		}
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			return ClientConn{}, nil
+		}
+		return q.popUnlock(), nil
+	}
+
+	// A stored client is handed out even if ctx is already done: only the
+	// wait for one is bounded
+	q.mu.Lock()
+	tokens, resized := q.tokens, q.resized
+	q.mu.Unlock()
+	ok := true
+	select {
+	case _, ok = <-tokens:
+	default:
+		select {
+		case <-wait:
+			// A wait that already fired, as for TryGet, gives up without
+			// blocking
+			return ClientConn{}, ErrTimeout
+		default:
+		}
+		if q.onBlock != nil {
+			q.onBlock()
+		}
+		var start time.Time
+		if q.onWait != nil {
+			start = q.clock.Now()
+		}
+	waiting:
+		for {
+			select {
+			case _, ok = <-tokens:
+				break waiting
+			case <-resized:
+				// Wait on the tokens of the resized queue instead
+				q.mu.Lock()
+				tokens, resized = q.tokens, q.resized
+				q.mu.Unlock()
+			case <-ctx.Done():
+				return ClientConn{}, ErrTimeout // it would better returns ctx.Err()
+			case <-wait:
+				return ClientConn{}, ErrTimeout
+			}
+		}
+		if ok && q.onWait != nil {
+			q.onWait(q.clock.Now().Sub(start))
+		}
+	}
+	if !ok {
+		return ClientConn{}, ErrClosed
+	}
+
+	q.mu.Lock()
+	// The queue may have been emptied by close after we got our token
+	if q.closed || q.size() == 0 {
+		q.mu.Unlock()
+		return ClientConn{}, ErrClosed
+	}
+	return q.popUnlock(), nil
+}
+
+// popUnlock pops the next client to hand out and unlocks the queue, the
+// queue must be locked and not empty. A panic of the selector is reported
+// once the queue is unlocked
+func (q *connQueue) popUnlock() ClientConn {
+	c, recovered := q.pop()
+	q.mu.Unlock()
+
+	if recovered != nil && q.onSelectorPanic != nil {
+		q.onSelectorPanic(recovered)
+	}
+	return c
+}
+
+// pop removes the next client to hand out, the queue must be locked and not
+// empty. An elastic queue hands out its connections before its placeholders.
+// A panicking selector falls back to the checkout order, pop returning the
+// recovered value
+func (q *connQueue) pop() (ClientConn, interface{}) {
+	if q.elastic && len(q.items) == 0 {
+		q.empty--
+		q.lenChanged()
+		return ClientConn{}, nil
+	}
+
+	i := 0
+	if q.order == LIFO {
+		i = len(q.items) - 1
+	}
+	var recovered interface{}
+	if q.selector != nil {
+		candidates := make([]*ClientConn, len(q.items))
+		for j := range q.items {
+			c := q.items[j]
+			candidates[j] = &c
+		}
+		j, r := q.selectFrom(candidates)
+		if r != nil {
+			recovered = r
+		} else if j >= 0 && j < len(q.items) {
+			i = j
+		}
+	}
+
+	c := q.items[i]
+	if i == 0 {
+		q.items[0] = ClientConn{}
+		q.items = q.items[1:]
+	} else {
+		last := len(q.items) - 1
+		copy(q.items[i:], q.items[i+1:])
+		q.items[last] = ClientConn{}
+		q.items = q.items[:last]
+	}
+	q.shrink()
+	q.lenChanged()
+	return c, recovered
+}
+
+// selectFrom calls the selector, returning the value recovered from its
+// panic if any. The queue must be locked
+func (q *connQueue) selectFrom(candidates []*ClientConn) (i int, recovered interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			i, recovered = -1, r
+		}
+	}()
+	return q.selector(candidates), nil
+}
+
+// shrink reallocates the slice of an elastic queue once it's mostly unused,
+// so that its memory follows the number of idle connections
+func (q *connQueue) shrink() {
+	if !q.elastic || cap(q.items) < 16 || len(q.items) >= cap(q.items)/4 {
+		return
+	}
+	items := make([]ClientConn, len(q.items), 2*len(q.items))
+	copy(items, q.items)
+	q.items = items
+}
+
+// fill stores a client in place of a placeholder, or adds it to an unlimited
+// queue. It returns false if the queue holds no placeholder or was closed
+func (q *connQueue) fill(c ClientConn) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	if q.unlimited {
+		q.items = append(q.items, c)
+		return true
+	}
+	if q.elastic {
+		if q.empty == 0 {
+			return false
+		}
+		q.empty--
+		q.items = append(q.items, c)
+		return true
+	}
+	for i := range q.items {
+		if q.items[i].ClientConn == nil {
+			q.items[i] = c
+			return true
+		}
+	}
+	return false
+}
+
+// take removes the first stored client matching match without waiting. It
+// returns false if there is none, or if all the stored clients are already
+// promised to getters.
+func (q *connQueue) take(match func(ClientConn) bool) (ClientConn, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ClientConn{}, false
+	}
+	for i, c := range q.items {
+		if !match(c) {
+			continue
+		}
+		if !q.unlimited {
+			select {
+			case <-q.tokens:
+			default:
+				return ClientConn{}, false
+			}
+		}
+		last := len(q.items) - 1
+		copy(q.items[i:], q.items[i+1:])
+		q.items[last] = ClientConn{}
+		q.items = q.items[:last]
+		q.lenChanged()
+		return c, true
+	}
+	return ClientConn{}, false
+}
+
+// each calls fn on every stored client, with the queue locked. fn can modify
+// the clients but not add or remove any. An unlimited or elastic queue then
+// drops the clients fn turned into placeholders, the latter counting them.
+func (q *connQueue) each(fn func(*ClientConn)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := range q.items {
+		fn(&q.items[i])
+	}
+	if q.unlimited || q.elastic {
+		items := q.items[:0]
+		for _, c := range q.items {
+			if c.ClientConn != nil {
+				items = append(items, c)
+			}
+		}
+		for i := len(items); i < len(q.items); i++ {
+			q.items[i] = ClientConn{}
+		}
+		if q.elastic {
+			q.empty += len(q.items) - len(items)
+		}
+		q.items = items
+		q.shrink()
+	}
+}
+
+// resize changes the capacity of a bounded queue. Growing it adds
+// placeholders. Shrinking it removes placeholders first, then idle clients,
+// which it returns for the caller to close. The clients it couldn't remove as
+// they're checked out are dropped by store when they're given back, drained
+// being closed once they all were, nil if there is none
+func (q *connQueue) resize(capacity int) ([]ClientConn, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.unlimited {
+		return nil, nil
+	}
+
+	// The tokens left are the ones of the stored clients not promised to a
+	// getter yet, the only ones that can be removed
+	tokens := 0
+drain:
+	for {
+		select {
+		case <-q.tokens:
+			tokens++
+		default:
+			break drain
+		}
+	}
+	var removed []ClientConn
+	if diff := capacity - cap(q.tokens); diff > 0 {
+		cancelled := diff
+		if cancelled > q.surplus {
+			cancelled = q.surplus
+		}
+		q.surplus -= cancelled
+		for i := cancelled; i < diff; i++ {
+			if q.elastic {
+				q.empty++
+			} else {
+				q.push(ClientConn{})
+			}
+			tokens++
+		}
+	} else if diff < 0 {
+		n := -diff
+		if n > tokens {
+			q.surplus += n - tokens
+			n = tokens
+		}
+		tokens -= n
+		removed = q.remove(n)
+	}
+
+	if !q.elastic {
+		// Keep the clients at the start of a backing array of the new
+		// capacity, see push
+		size := capacity
+		if len(q.items) > size {
+			size = len(q.items)
+		}
+		q.buf = make([]ClientConn, len(q.items), size)
+		copy(q.buf, q.items)
+		q.items = q.buf
+	}
+	q.tokens = make(chan struct{}, capacity)
+	for i := 0; i < tokens; i++ {
+		q.tokens <- struct{}{}
+	}
+	close(q.resized)
+	q.resized = make(chan struct{})
+	if q.surplus > 0 && q.drained == nil {
+		q.drained = make(chan struct{})
+	} else if q.surplus == 0 && q.drained != nil {
+		close(q.drained)
+		q.drained = nil
+	}
+	q.lenChanged()
+	return removed, q.drained
+}
+
+// remove removes n stored clients, the placeholders first, and returns the
+// idle clients among them. The queue must be locked and hold n clients
+func (q *connQueue) remove(n int) []ClientConn {
+	if q.elastic {
+		empty := n
+		if empty > q.empty {
+			empty = q.empty
+		}
+		q.empty -= empty
+		n -= empty
+	}
+	items := q.items[:0]
+	for _, c := range q.items {
+		if n > 0 && c.ClientConn == nil {
+			n--
+			continue
+		}
+		items = append(items, c)
+	}
+	var removed []ClientConn
+	if n > 0 {
+		removed = append(removed, items[:n]...)
+		items = items[:copy(items, items[n:])]
+	}
+	for i := len(items); i < len(q.items); i++ {
+		q.items[i] = ClientConn{}
+	}
+	q.items = items
+	return removed
+}
+
+// lenChanged notifies onLen, the queue must be locked
+func (q *connQueue) lenChanged() {
+	if q.onLen != nil {
+		q.onLen(q.size())
+	}
+}
+
+// close marks the queue as closed, waking up the waiting getters, and
+// returns the clients it held
+func (q *connQueue) close() []ClientConn {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	if !q.unlimited {
+		close(q.tokens)
+	}
+	if q.drained != nil {
+		close(q.drained)
+		q.drained = nil
+	}
+
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// len returns the number of stored clients. A nil queue is empty
+func (q *connQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size()
+}
+
+// size returns the number of stored clients, the queue must be locked
+func (q *connQueue) size() int {
+	return len(q.items) + q.empty
+}
+
+// cap returns the maximum number of stored clients, -1 if it's unlimited. A
+// nil queue can't store any
+func (q *connQueue) cap() int {
+	if q == nil {
+		return 0
+	}
+	if q.unlimited {
+		return -1
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return cap(q.tokens)
+}
@@ -0,0 +1,131 @@
+package grpcpool
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// reapLoop reaps the pool every interval until it's closed
+func (p *Pool) reapLoop(interval time.Duration) {
+	defer close(p.reaped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.reap()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// reap closes the idle connections unused for longer than the idle timeout
+// or older than the max life duration, wherever they are in the queue. With
+// WithBurst, it also closes the idle connections beyond the soft capacity
+// unused for longer than the burst TTL. In a bounded pool they're replaced
+// with placeholders, an unlimited pool drops them altogether. The checked out
+// connections past their max life are recycled when they're given back.
+func (p *Pool) reap() {
+	clients := p.getClients()
+	idleTimeout, maxLife, _ := p.timeouts()
+	if clients == nil || (idleTimeout <= 0 && maxLife <= 0 && p.burstTTL <= 0) {
+		return
+	}
+
+	// extra is the number of connections beyond the soft capacity
+	extra := 0
+	if p.burstTTL > 0 {
+		p.connsMu.Lock()
+		extra = len(p.conns) - p.burstSoft
+		p.connsMu.Unlock()
+	}
+
+	now := p.clock.Now()
+	var stale []*grpc.ClientConn
+	var reasons []recycleReason
+	clients.each(func(c *ClientConn) {
+		if c.ClientConn == nil {
+			return
+		}
+		switch {
+		case idleTimeout > 0 && c.timeUsed.Add(idleTimeout).Before(now):
+			reasons = append(reasons, recycleIdle)
+		case p.expired(c.timeInitiated, effectiveMaxLife(c.maxLife, maxLife), now):
+			reasons = append(reasons, recycleMaxLife)
+		case extra > 0 && c.timeUsed.Add(p.burstTTL).Before(now):
+			reasons = append(reasons, recycleBurst)
+		default:
+			return
+		}
+		extra--
+		stale = append(stale, c.ClientConn)
+		*c = ClientConn{
+			pool: p,
+		}
+	})
+	for i, cc := range stale {
+		p.destroy(cc, reasons[i])
+	}
+}
+
+// sweep reaps the pool from Get when there is no reaper, at most once per
+// idle timeout, max life duration or burst TTL, whichever is shorter. Get
+// only checks the client it hands out, so that the clients it doesn't reach,
+// such as the ones kept behind by WithReturnToFront or a connection selector,
+// still get recycled
+func (p *Pool) sweep() {
+	var every time.Duration
+	idleTimeout, maxLife, _ := p.timeouts()
+	for _, d := range []time.Duration{idleTimeout, maxLife, p.burstTTL} {
+		if d > 0 && (every <= 0 || d < every) {
+			every = d
+		}
+	}
+	if p.reapInterval > 0 || every <= 0 {
+		return
+	}
+
+	now := p.clock.Now().UnixNano()
+	last := atomic.LoadInt64(&p.lastSweep)
+	if now-last < int64(every) || !atomic.CompareAndSwapInt64(&p.lastSweep, last, now) {
+		return
+	}
+	p.reap()
+}
+
+// expired returns whether a connection created at timeInitiated outlived its
+// max life at now
+func (p *Pool) expired(timeInitiated time.Time, maxLife time.Duration, now time.Time) bool {
+	// If the sum of the initialization time and the max duration is before
+	// now, it means the initialization is so old adding the maximum duration
+	// couldn't put it in the future
+	return maxLife > 0 && timeInitiated.Add(maxLife).Before(now)
+}
+
+// effectiveMaxLife returns the max life of a connection given the one it was
+// created with and the current max life duration of the pool, the latter
+// applying to the existing connections once it's shorter, see
+// SetMaxLifeDuration
+func effectiveMaxLife(maxLife, current time.Duration) time.Duration {
+	if current > 0 && (maxLife <= 0 || current < maxLife) {
+		return current
+	}
+	return maxLife
+}
+
+// connMaxLife returns the max life of a new connection: the max life
+// duration, shifted by up to the WithMaxLifeJitter fraction of it so that
+// the connections created together don't expire together
+func (p *Pool) connMaxLife() time.Duration {
+	_, maxLife, _ := p.timeouts()
+	if maxLife <= 0 || p.maxLifeJitter <= 0 {
+		return maxLife
+	}
+	shift := (2*rand.Float64() - 1) * p.maxLifeJitter
+	return maxLife + time.Duration(float64(maxLife)*shift)
+}
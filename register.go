@@ -0,0 +1,73 @@
+package grpcpool
+
+import (
+	"sort"
+	"sync"
+)
+
+// pools is the package level registry of named pools, see Register
+var pools = struct {
+	sync.Mutex
+	byName map[string]*Pool
+}{
+	byName: make(map[string]*Pool),
+}
+
+// Register adds p to the package level registry under name, so that pools
+// created all over a codebase can be looked up, listed and closed from a
+// single place. It returns ErrAlreadyRegistered if a pool is already
+// registered under name.
+func Register(name string, p *Pool) error {
+	pools.Lock()
+	defer pools.Unlock()
+
+	if _, ok := pools.byName[name]; ok {
+		return ErrAlreadyRegistered
+	}
+	pools.byName[name] = p
+	return nil
+}
+
+// Unregister removes the pool registered under name, if any, without closing
+// it
+func Unregister(name string) {
+	pools.Lock()
+	defer pools.Unlock()
+
+	delete(pools.byName, name)
+}
+
+// Lookup returns the pool registered under name
+func Lookup(name string) (*Pool, bool) {
+	pools.Lock()
+	defer pools.Unlock()
+
+	p, ok := pools.byName[name]
+	return p, ok
+}
+
+// Registered returns the names of the registered pools, sorted
+func Registered() []string {
+	pools.Lock()
+	defer pools.Unlock()
+
+	names := make([]string, 0, len(pools.byName))
+	for name := range pools.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CloseAll closes all the registered pools and empties the registry, for
+// instance when the process shuts down
+func CloseAll() {
+	pools.Lock()
+	registered := pools.byName
+	pools.byName = make(map[string]*Pool)
+	pools.Unlock()
+
+	for _, p := range registered {
+		p.Close()
+	}
+}
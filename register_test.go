@@ -0,0 +1,50 @@
+package grpcpool
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func TestRegister(t *testing.T) {
+	factory := func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}
+	billing, err := NewWithOptions(context.Background(), factory, WithInitialConns(1))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	users, err := NewWithOptions(context.Background(), factory, WithInitialConns(1))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+
+	if err := Register("billing", billing); err != nil {
+		t.Errorf("Register returned an error: %s", err.Error())
+	}
+	if err := Register("users", users); err != nil {
+		t.Errorf("Register returned an error: %s", err.Error())
+	}
+	if err := Register("billing", users); err != ErrAlreadyRegistered {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrAlreadyRegistered, err)
+	}
+	if p, ok := Lookup("billing"); !ok || p != billing {
+		t.Error("Lookup should have returned the billing pool")
+	}
+	if _, ok := Lookup("orders"); ok {
+		t.Error("Lookup should not have found a pool")
+	}
+	if names := Registered(); !reflect.DeepEqual(names, []string{"billing", "users"}) {
+		t.Errorf("The registered pools were %v", names)
+	}
+
+	CloseAll()
+	if !billing.IsClosed() || !users.IsClosed() {
+		t.Error("CloseAll should have closed all the pools")
+	}
+	if names := Registered(); len(names) != 0 {
+		t.Errorf("The registry should be empty but held %v", names)
+	}
+}
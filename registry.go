@@ -0,0 +1,249 @@
+package grpcpool
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// ConnInfo describes a connection held by the pool, whether it's idle or
+// checked out
+type ConnInfo struct {
+	// Target is the target the connection was dialed to
+	Target string
+	// Age is the time elapsed since the connection was created
+	Age time.Duration
+	// IdleTime is the time elapsed since the connection was last returned
+	// to the pool. It's 0 while the connection is checked out
+	IdleTime time.Duration
+	// InUse is true if the connection is currently checked out
+	InUse bool
+	// State is the grpc connectivity state of the connection
+	State connectivity.State
+	// Healthy is false if the connection was marked as unhealthy
+	Healthy bool
+}
+
+// connRecord is the registry entry of a live connection
+type connRecord struct {
+	timeInitiated time.Time
+	timeUsed      time.Time
+	inUse         bool
+	unhealthy     bool
+	// lease counts the checkouts of the connection, telling the wrapper of
+	// the current one from the stale copies of the previous ones
+	lease uint64
+	// keys are the affinity keys pointing to the connection
+	keys []string
+}
+
+// track adds a newly created connection to the registry and returns its
+// lease
+func (p *Pool) track(cc *grpc.ClientConn, inUse bool) uint64 {
+	now := p.clock.Now()
+
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	if p.conns == nil {
+		p.conns = make(map[*grpc.ClientConn]*connRecord)
+	}
+	r := &connRecord{
+		timeInitiated: now,
+		timeUsed:      now,
+		inUse:         inUse,
+	}
+	if inUse {
+		r.lease = 1
+	}
+	p.conns[cc] = r
+	return r.lease
+}
+
+// untrack removes a connection from the registry once it's closed, along
+// with the affinity keys pointing to it. It returns the removed entry, nil if
+// the connection wasn't registered
+func (p *Pool) untrack(cc *grpc.ClientConn) *connRecord {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	r, ok := p.conns[cc]
+	if !ok {
+		return nil
+	}
+	for _, key := range r.keys {
+		delete(p.affinity, key)
+	}
+	delete(p.conns, cc)
+	return r
+}
+
+// markInUse updates the registry when a connection is checked out or
+// returned to the pool and returns its lease, which a checkout renews
+func (p *Pool) markInUse(cc *grpc.ClientConn, inUse bool) uint64 {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	r, ok := p.conns[cc]
+	if !ok {
+		return 0
+	}
+	if inUse && !r.inUse {
+		r.lease++
+	}
+	r.inUse = inUse
+	if !inUse {
+		r.timeUsed = p.clock.Now()
+	}
+	return r.lease
+}
+
+// checkin marks a checked out connection as returned to the pool. It
+// returns false if the lease isn't the current one, meaning the checkout was
+// already given back through another copy of its wrapper
+func (p *Pool) checkin(cc *grpc.ClientConn, lease uint64) bool {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	r, ok := p.conns[cc]
+	if !ok || !r.inUse || r.lease != lease {
+		return false
+	}
+	r.inUse = false
+	r.timeUsed = p.clock.Now()
+	return true
+}
+
+// markUnhealthy flags a connection as unhealthy in the registry
+func (p *Pool) markUnhealthy(cc *grpc.ClientConn) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	if r, ok := p.conns[cc]; ok {
+		r.unhealthy = true
+	}
+}
+
+// UnhealthyPending returns the number of checked out connections marked as
+// unhealthy, which the pool closes once they're given back. A number that
+// keeps growing means their holders never return them. It's 0 once the pool
+// is closed
+func (p *Pool) UnhealthyPending() int {
+	if p.IsClosed() {
+		return 0
+	}
+
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	n := 0
+	for _, r := range p.conns {
+		if r.inUse && r.unhealthy {
+			n++
+		}
+	}
+	return n
+}
+
+const (
+	// failFastDials is the number of consecutive factory failures after
+	// which WithFailFastWhenUnhealthy makes Get fail
+	failFastDials = 3
+	// failFastRetry is the time after the last factory failure after which
+	// Get tries to create a connection again
+	failFastRetry = time.Second
+)
+
+// unhealthy returns true if all the connections of the pool are marked as
+// unhealthy, or there is none, and the last failFastDials dials failed less
+// than failFastRetry ago
+func (p *Pool) unhealthy() bool {
+	if atomic.LoadInt32(&p.dialFailures) < failFastDials {
+		return false
+	}
+	last := time.Unix(0, atomic.LoadInt64(&p.lastDialFailure))
+	if !p.clock.Now().Before(last.Add(failFastRetry)) {
+		return false
+	}
+
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	for _, r := range p.conns {
+		if !r.unhealthy {
+			return false
+		}
+	}
+	return true
+}
+
+// Inspect returns a snapshot of all the connections currently held by the
+// pool, including the checked out ones, from the oldest to the newest.
+// Placeholders for not yet created connections aren't listed. It doesn't
+// alter the pool in any way.
+func (p *Pool) Inspect() []ConnInfo {
+	if p.IsClosed() {
+		return nil
+	}
+
+	now := p.clock.Now()
+	p.connsMu.Lock()
+	ccs := make([]*grpc.ClientConn, 0, len(p.conns))
+	infos := make([]ConnInfo, 0, len(p.conns))
+	for cc, r := range p.conns {
+		info := ConnInfo{
+			Target:  cc.Target(),
+			Age:     now.Sub(r.timeInitiated),
+			InUse:   r.inUse,
+			Healthy: !r.unhealthy,
+		}
+		if !r.inUse {
+			info.IdleTime = now.Sub(r.timeUsed)
+		}
+		ccs = append(ccs, cc)
+		infos = append(infos, info)
+	}
+	p.connsMu.Unlock()
+
+	// The states are read outside of the registry lock as GetState takes
+	// the connection's own lock
+	for i, cc := range ccs {
+		infos[i].State = cc.GetState()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Age > infos[j].Age
+	})
+	return infos
+}
+
+// Ready returns true if at least one connection of the pool, idle or checked
+// out, is in the READY state, for instance for a readiness probe. It neither
+// blocks nor dials: the idle connections it comes across are asked to connect
+// in the background, so that a pool created without waiting for its
+// connections becomes ready. It's false for a closed pool or one without any
+// connection yet
+func (p *Pool) Ready() bool {
+	if p.IsClosed() {
+		return false
+	}
+
+	p.connsMu.Lock()
+	ccs := make([]*grpc.ClientConn, 0, len(p.conns))
+	for cc := range p.conns {
+		ccs = append(ccs, cc)
+	}
+	p.connsMu.Unlock()
+
+	for _, cc := range ccs {
+		switch cc.GetState() {
+		case connectivity.Ready:
+			return true
+		case connectivity.Idle:
+			cc.Connect()
+		}
+	}
+	return false
+}
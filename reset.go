@@ -0,0 +1,50 @@
+package grpcpool
+
+import (
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+)
+
+// Reset recycles all the connections of the pool without closing it. The
+// idle connections are closed right away and replaced with placeholders, so
+// that Get creates new ones. The checked out connections are marked as
+// unhealthy and get closed when they're returned. The pool stays usable
+// throughout. It returns ErrClosed if the pool is closed.
+func (p *Pool) Reset() error {
+	clients := p.getClients()
+	if clients == nil {
+		return ErrClosed
+	}
+
+	// Bumping the generation makes every connection created before stale,
+	// including the ones being checked out or returned concurrently
+	atomic.AddUint64(&p.generation, 1)
+
+	var stale []*grpc.ClientConn
+	clients.each(func(c *ClientConn) {
+		if c.ClientConn != nil {
+			stale = append(stale, c.ClientConn)
+			*c = ClientConn{
+				pool: p,
+			}
+		}
+	})
+	for _, cc := range stale {
+		p.destroy(cc, recycleReset)
+	}
+
+	p.connsMu.Lock()
+	for _, r := range p.conns {
+		if r.inUse {
+			r.unhealthy = true
+		}
+	}
+	p.connsMu.Unlock()
+	return nil
+}
+
+// currentGeneration returns the number of times the pool was reset
+func (p *Pool) currentGeneration() uint64 {
+	return atomic.LoadUint64(&p.generation)
+}
@@ -0,0 +1,55 @@
+package grpcpool
+
+import (
+	"context"
+	"fmt"
+)
+
+// Resize changes the capacity of the pool while it's in use. Growing it adds
+// placeholders, the new connections being created by Get. Shrinking it closes
+// idle connections right away, the placeholders being dropped first, and the
+// checked out connections beyond the new capacity as they're given back.
+// Resize then waits for them until ctx is done, returning ctx.Err(), the pool
+// being resized anyway. It returns ErrUnlimited for an unlimited pool and
+// ErrClosed once the pool is closed.
+func (p *Pool) Resize(ctx context.Context, capacity int) error {
+	drained, err := p.resize(capacity)
+	if err != nil || drained == nil {
+		return err
+	}
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// resize implements Resize without waiting, returning the channel closed once
+// the checked out connections beyond the new capacity were given back, nil if
+// there is none
+func (p *Pool) resize(capacity int) (<-chan struct{}, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("%w: capacity %d isn't positive", ErrInvalidConfig, capacity)
+	}
+	clients := p.getClients()
+	if clients == nil {
+		return nil, ErrClosed
+	}
+	if clients.unlimited {
+		return nil, ErrUnlimited
+	}
+
+	// The pool lock keeps the capacity in sync with the queue when Resize
+	// is called concurrently
+	p.mu.Lock()
+	removed, drained := clients.resize(capacity)
+	p.capacity = capacity
+	p.mu.Unlock()
+
+	for _, c := range removed {
+		p.destroy(c.ClientConn, recycleResize)
+	}
+	return drained, nil
+}
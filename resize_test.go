@@ -0,0 +1,169 @@
+package grpcpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestResizeGrow(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(1), WithInitialConns(1))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	first, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err.Error())
+	}
+	defer first.Close()
+
+	// A Get waiting for the full pool is served once it grows
+	events := p.Events()
+	got := make(chan error, 1)
+	go func() {
+		client, err := p.Get(context.Background())
+		if err == nil {
+			client.Close()
+		}
+		got <- err
+	}()
+	for blocked := false; !blocked; {
+		select {
+		case e := <-events:
+			blocked = e.Kind == GetBlocked
+		case <-time.After(5 * time.Second):
+			t.Fatal("Get should have waited for a client")
+		}
+	}
+	if err := p.Resize(context.Background(), 3); err != nil {
+		t.Fatalf("Resize returned an error: %s", err.Error())
+	}
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get should have been served once the pool grew")
+	}
+	if c := p.Capacity(); c != 3 {
+		t.Errorf("The pool capacity was %d but should be 3", c)
+	}
+	if a := p.Available(); a != 2 {
+		t.Errorf("The pool available was %d but should be 2", a)
+	}
+	if c := p.Config().Capacity; c != 3 {
+		t.Errorf("The pool config capacity was %d but should be 3", c)
+	}
+}
+
+func TestResizeShrink(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(4), WithInitialConns(3))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	first, _ := p.Get(context.Background())
+	second, _ := p.Get(context.Background())
+	third, _ := p.Get(context.Background())
+
+	// The placeholder goes right away, two of the checked out connections
+	// when they're given back
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Resize(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", context.DeadlineExceeded, err)
+	}
+	if c := p.Capacity(); c != 1 {
+		t.Errorf("The pool capacity was %d but should be 1", c)
+	}
+	if a := p.Available(); a != 0 {
+		t.Errorf("The pool available was %d but should be 0", a)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Resize(context.Background(), 1)
+	}()
+	if err := first.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+	if err := second.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Resize returned an error: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Resize should have returned once the pool was drained")
+	}
+	if err := third.Close(); err != nil {
+		t.Errorf("Close returned an error: %s", err.Error())
+	}
+
+	if a := p.Available(); a != 1 {
+		t.Errorf("The pool available was %d but should be 1", a)
+	}
+	s := p.Stats()
+	if s.Open != 1 || s.RecycledResize != 2 {
+		t.Errorf("The pool had %d open connections and recycled %d but should have 1 and 2",
+			s.Open, s.RecycledResize)
+	}
+}
+
+func TestResizeShrinkIdle(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}, WithCapacity(3), WithInitialConns(3))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	if err := p.Resize(context.Background(), 1); err != nil {
+		t.Fatalf("Resize returned an error: %s", err.Error())
+	}
+	s := p.Stats()
+	if s.Available != 1 || s.Open != 1 || s.RecycledResize != 2 {
+		t.Errorf("The pool had %d available and %d open connections and recycled %d but should have 1, 1 and 2",
+			s.Available, s.Open, s.RecycledResize)
+	}
+}
+
+func TestResizeErrors(t *testing.T) {
+	factory := func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.Dial("example.com", grpc.WithInsecure())
+	}
+	p, err := NewWithOptions(context.Background(), factory, WithUnlimited())
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	if err := p.Resize(context.Background(), 2); err != ErrUnlimited {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrUnlimited, err)
+	}
+	p.Close()
+
+	p, err = NewWithOptions(context.Background(), factory, WithCapacity(2))
+	if err != nil {
+		t.Fatalf("The pool returned an error: %s", err.Error())
+	}
+	if err := p.Resize(context.Background(), 0); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrInvalidConfig, err)
+	}
+	p.Close()
+	if err := p.Resize(context.Background(), 2); err != ErrClosed {
+		t.Errorf("Expected error \"%s\" but got \"%v\"", ErrClosed, err)
+	}
+}
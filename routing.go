@@ -0,0 +1,55 @@
+package grpcpool
+
+import (
+	"context"
+	"math/rand"
+)
+
+// RoutingPool splits the Get calls between two pools, to move the traffic
+// from an old pool to a new one gradually, for instance when migrating to a
+// new backend
+type RoutingPool struct {
+	old    *Pool
+	next   *Pool
+	weight func() float64
+}
+
+// Handover creates a RoutingPool handing out the clients of next with the
+// probability returned by weight, and the clients of old otherwise. weight is
+// called on every Get, it must be cheap and safe for concurrent use: ramping
+// it from 0 to 1 moves the traffic over to next.
+func Handover(old, next *Pool, weight func() float64) *RoutingPool {
+	return &RoutingPool{
+		old:    old,
+		next:   next,
+		weight: weight,
+	}
+}
+
+// Get returns a client of the pool picked according to the weight. The
+// client is given back to the pool it comes from when it's closed
+func (r *RoutingPool) Get(ctx context.Context) (*ClientConn, error) {
+	return r.pick().Get(ctx)
+}
+
+// pick returns the pool the next Get goes to
+func (r *RoutingPool) pick() *Pool {
+	w := r.weight()
+	switch {
+	case w <= 0:
+		return r.old
+	case w >= 1:
+		return r.next
+	case rand.Float64() < w:
+		return r.next
+	default:
+		return r.old
+	}
+}
+
+// Close closes both pools, the clients still checked out being closed when
+// they're given back
+func (r *RoutingPool) Close() {
+	r.old.Close()
+	r.next.Close()
+}
@@ -0,0 +1,49 @@
+package grpcpool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func TestHandover(t *testing.T) {
+	newPool := func() *Pool {
+		p, err := NewWithOptions(context.Background(), func(ctx context.Context) (*grpc.ClientConn, error) {
+			return grpc.Dial("example.com", grpc.WithInsecure())
+		}, WithCapacity(1))
+		if err != nil {
+			t.Errorf("The pool returned an error: %s", err.Error())
+		}
+		return p
+	}
+	old, next := newPool(), newPool()
+
+	var weight atomic.Value
+	weight.Store(0.0)
+	r := Handover(old, next, func() float64 {
+		return weight.Load().(float64)
+	})
+
+	for _, w := range []float64{0, 1} {
+		weight.Store(w)
+		want := old
+		if w == 1 {
+			want = next
+		}
+		c, err := r.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		if c.pool != want {
+			t.Errorf("Get with a weight of %v picked the wrong pool", w)
+		}
+		c.Close()
+	}
+
+	r.Close()
+	if !old.IsClosed() || !next.IsClosed() {
+		t.Error("Close should have closed both pools")
+	}
+}
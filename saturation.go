@@ -0,0 +1,61 @@
+package grpcpool
+
+import (
+	"sync/atomic"
+)
+
+// SaturationState is the saturation state of a pool
+type SaturationState int
+
+const (
+	// Recovered means clients are available again after the pool was
+	// saturated
+	Recovered SaturationState = iota
+	// Saturated means no client is available anymore: Get has to wait for
+	// one to be returned
+	Saturated
+)
+
+func (s SaturationState) String() string {
+	if s == Saturated {
+		return "Saturated"
+	}
+	return "Recovered"
+}
+
+// SaturationEvents returns a channel receiving the saturation state of the
+// pool each time it changes: Saturated when the last available client is
+// checked out and Recovered when one is available again. The channel is
+// conflated: a consumer too slow to keep up only misses the intermediate
+// states, and always receives the latest one.
+func (p *Pool) SaturationEvents() <-chan SaturationState {
+	return p.saturation
+}
+
+// updateSaturation is called by the queue each time its length changes,
+// with the queue locked so that the events are sent in order
+func (p *Pool) updateSaturation(available int) {
+	var state int32
+	if available == 0 {
+		state = int32(Saturated)
+	}
+	if atomic.SwapInt32(&p.saturated, state) == state {
+		return
+	}
+
+	// Replace the pending state, if any, so that a slow consumer never
+	// blocks the pool
+	select {
+	case p.saturation <- SaturationState(state):
+		return
+	default:
+	}
+	select {
+	case <-p.saturation:
+	default:
+	}
+	select {
+	case p.saturation <- SaturationState(state):
+	default:
+	}
+}
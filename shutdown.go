@@ -0,0 +1,95 @@
+package grpcpool
+
+import (
+	"context"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+)
+
+// created counts a new live connection
+func (p *Pool) created() {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	p.live++
+}
+
+// released counts a live connection as closed
+func (p *Pool) released() {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	p.live--
+	p.checkDrained()
+}
+
+// destroy removes a connection from the registry and closes it, counting it
+// in the Stats under reason. Every connection the pool closes goes through it,
+// and only the first call for a connection closes it: a connection that isn't
+// registered anymore was already destroyed.
+func (p *Pool) destroy(cc *grpc.ClientConn, reason recycleReason) {
+	r := p.untrack(cc)
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&p.recycled[reason], 1)
+	p.emit(Event{
+		Kind:   ConnClosed,
+		Target: cc.Target(),
+		Age:    p.clock.Now().Sub(r.timeInitiated),
+		Reason: reason.String(),
+	})
+	if p.tiers != nil {
+		p.tiers.forget(cc)
+	}
+	cc.Close()
+	p.released()
+}
+
+// shutdown records that the pool was closed, so that WaitClosed returns once
+// the remaining connections are closed
+func (p *Pool) shutdown() {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	p.closing = true
+	p.affinity = nil
+	p.checkDrained()
+}
+
+// checkDrained closes drained if the pool was closed and all its connections
+// too, connsMu must be held
+func (p *Pool) checkDrained() {
+	if !p.closing || p.live > 0 {
+		return
+	}
+	if p.drained == nil {
+		p.drained = make(chan struct{})
+	}
+	select {
+	case <-p.drained:
+	default:
+		close(p.drained)
+	}
+}
+
+// WaitClosed waits until the pool was closed and all the connections it
+// created were closed, including the ones that were checked out when the pool
+// was closed and got closed when their holders gave them back. It returns
+// ctx.Err() if ctx is done first.
+func (p *Pool) WaitClosed(ctx context.Context) error {
+	p.connsMu.Lock()
+	if p.drained == nil {
+		p.drained = make(chan struct{})
+	}
+	drained := p.drained
+	p.connsMu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,185 @@
+package grpcpool
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// recycleReason is the reason why the pool closed a connection
+type recycleReason int
+
+const (
+	// recycleDiscarded is for the connections the pool didn't keep, as it
+	// was closed or failed to be created
+	recycleDiscarded recycleReason = iota
+	recycleIdle
+	recycleMaxLife
+	recycleUnhealthy
+	recycleHealthCheck
+	recycleReset
+	recycleMaxIdle
+	recycleMaxRequests
+	recycleBurst
+	recycleResize
+	recycleReasons
+)
+
+func (r recycleReason) String() string {
+	switch r {
+	case recycleIdle:
+		return "idle"
+	case recycleMaxLife:
+		return "max life"
+	case recycleUnhealthy:
+		return "unhealthy"
+	case recycleHealthCheck:
+		return "health check"
+	case recycleReset:
+		return "reset"
+	case recycleMaxIdle:
+		return "max idle"
+	case recycleMaxRequests:
+		return "max requests"
+	case recycleBurst:
+		return "burst"
+	case recycleResize:
+		return "resize"
+	}
+	return "discarded"
+}
+
+// waitBounds are the upper bounds of the buckets of Stats.WaitHistogram, the
+// last bucket counting the waits of at least the last bound
+var waitBounds = [...]time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// Stats is a snapshot of the usage of a pool
+type Stats struct {
+	// Capacity is the maximum number of clients of the pool
+	Capacity int
+	// Available is the number of idle clients, including the placeholders of
+	// the connections not created yet
+	Available int
+	// Open is the number of connections created by the pool and not closed
+	// yet, whether they're idle or checked out
+	Open int
+	// InUse is the number of checked out connections
+	InUse int
+	// UnhealthyPending is the number of checked out connections marked as
+	// unhealthy, waiting to be given back to be closed
+	UnhealthyPending int
+	// TotalWaitNanos is the cumulated time, in nanoseconds, Get spent
+	// waiting for a client to become available. Checkouts served without
+	// waiting don't count
+	TotalWaitNanos int64
+	// WaitHistogram counts the checkouts that had to wait by wait duration:
+	// under 1ms, under 10ms, under 100ms and 100ms or more
+	WaitHistogram [4]int64
+	// Dials is the number of connections the factory created
+	Dials int64
+	// TotalDialNanos and MaxDialNanos are the cumulated and the longest
+	// time, in nanoseconds, the factory took to create a connection. The
+	// failed dials don't count
+	TotalDialNanos int64
+	MaxDialNanos   int64
+	// RecycledIdle is the number of connections closed after being idle
+	// for longer than the idle timeout
+	RecycledIdle int64
+	// RecycledMaxLife is the number of connections closed after outliving
+	// the max life duration
+	RecycledMaxLife int64
+	// RecycledUnhealthy is the number of connections closed after being
+	// marked as unhealthy
+	RecycledUnhealthy int64
+	// RecycledHealthCheck is the number of connections closed as they
+	// didn't become ready in time or were drained by a GOAWAY
+	RecycledHealthCheck int64
+	// RecycledReset is the number of connections closed by Reset
+	RecycledReset int64
+	// RecycledMaxIdle is the number of connections closed as the pool
+	// already had WithMaxIdle idle connections
+	RecycledMaxIdle int64
+	// RecycledMaxRequests is the number of connections closed after
+	// WithMaxRequestsPerConn checkouts
+	RecycledMaxRequests int64
+	// RecycledBurst is the number of connections beyond the WithBurst soft
+	// capacity closed after being idle for the burst TTL
+	RecycledBurst int64
+	// RecycledResize is the number of connections closed as Resize shrank
+	// the pool
+	RecycledResize int64
+	// Discarded is the number of connections closed as the pool was closed,
+	// or failed to be created
+	Discarded int64
+	// DroppedEvents is the number of events dropped as the Events channel
+	// was full
+	DroppedEvents int64
+}
+
+// Stats returns a snapshot of the usage of the pool. It's the zero value
+// once the pool is closed
+func (p *Pool) Stats() Stats {
+	if p.IsClosed() {
+		return Stats{}
+	}
+
+	s := Stats{
+		Capacity:       p.Capacity(),
+		Available:      p.Available(),
+		TotalWaitNanos: atomic.LoadInt64(&p.waitNanos),
+	}
+	for i := range p.waitBuckets {
+		s.WaitHistogram[i] = atomic.LoadInt64(&p.waitBuckets[i])
+	}
+	s.Dials = atomic.LoadInt64(&p.dials)
+	s.TotalDialNanos = atomic.LoadInt64(&p.dialNanos)
+	s.MaxDialNanos = atomic.LoadInt64(&p.maxDialNanos)
+	s.RecycledIdle = atomic.LoadInt64(&p.recycled[recycleIdle])
+	s.RecycledMaxLife = atomic.LoadInt64(&p.recycled[recycleMaxLife])
+	s.RecycledUnhealthy = atomic.LoadInt64(&p.recycled[recycleUnhealthy])
+	s.RecycledHealthCheck = atomic.LoadInt64(&p.recycled[recycleHealthCheck])
+	s.RecycledReset = atomic.LoadInt64(&p.recycled[recycleReset])
+	s.RecycledMaxIdle = atomic.LoadInt64(&p.recycled[recycleMaxIdle])
+	s.RecycledMaxRequests = atomic.LoadInt64(&p.recycled[recycleMaxRequests])
+	s.RecycledBurst = atomic.LoadInt64(&p.recycled[recycleBurst])
+	s.RecycledResize = atomic.LoadInt64(&p.recycled[recycleResize])
+	s.Discarded = atomic.LoadInt64(&p.recycled[recycleDiscarded])
+	s.DroppedEvents = atomic.LoadInt64(&p.droppedEvents)
+	p.connsMu.Lock()
+	s.Open = len(p.conns)
+	for _, r := range p.conns {
+		if r.inUse {
+			s.InUse++
+			if r.unhealthy {
+				s.UnhealthyPending++
+			}
+		}
+	}
+	p.connsMu.Unlock()
+	return s
+}
+
+// recordWait accounts for a checkout that waited d for a client
+func (p *Pool) recordWait(d time.Duration) {
+	atomic.AddInt64(&p.waitNanos, int64(d))
+	i := 0
+	for i < len(waitBounds) && d >= waitBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&p.waitBuckets[i], 1)
+}
+
+// recordDial accounts for a connection the factory created in d
+func (p *Pool) recordDial(d time.Duration) {
+	atomic.AddInt64(&p.dials, 1)
+	atomic.AddInt64(&p.dialNanos, int64(d))
+	for {
+		max := atomic.LoadInt64(&p.maxDialNanos)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&p.maxDialNanos, max, int64(d)) {
+			return
+		}
+	}
+}
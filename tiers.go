@@ -0,0 +1,157 @@
+package grpcpool
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// Tier is a group of connections created with its own dialer, such as the
+// connections to a region, for WithTiers
+type Tier struct {
+	// Weight is the share of the connections of the pool going to the tier.
+	// A tier with a weight of 0 is only dialed when all the others fail
+	Weight int
+	// Dialer creates the connections of the tier
+	Dialer FactoryWithContext
+}
+
+// tierSet spreads the connections of a pool across its tiers
+type tierSet struct {
+	mu    sync.Mutex
+	tiers []Tier
+	// live is the number of connections of each tier, including the ones
+	// being dialed
+	live  []int
+	conns map[*grpc.ClientConn]int
+}
+
+// newTierSet creates a tierSet dialing with the given tiers
+func newTierSet(tiers []Tier) *tierSet {
+	return &tierSet{
+		tiers: tiers,
+		live:  make([]int, len(tiers)),
+		conns: make(map[*grpc.ClientConn]int),
+	}
+}
+
+// dial is the factory of a pool with tiers. It dials the tier the furthest
+// below its share of the connections, then the other tiers in order if it
+// fails, and returns the error of the last one if they all fail
+func (t *tierSet) dial(ctx context.Context) (*grpc.ClientConn, error) {
+	var err error
+	for _, i := range t.order() {
+		var cc *grpc.ClientConn
+		cc, err = t.dialTier(ctx, i)
+		if err == nil {
+			return cc, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	if err == nil {
+		err = ErrNoFactory
+	}
+	return nil, err
+}
+
+// dialTier dials a connection of the tier i, counting it in the tier while
+// it's being dialed
+func (t *tierSet) dialTier(ctx context.Context, i int) (cc *grpc.ClientConn, err error) {
+	t.mu.Lock()
+	t.live[i]++
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if cc == nil {
+			t.live[i]--
+			return
+		}
+		t.conns[cc] = i
+	}()
+
+	cc, err = t.tiers[i].Dialer(ctx)
+	if cc == nil && err == nil {
+		err = ErrNilConn
+	}
+	return cc, err
+}
+
+// order returns the tiers to dial in order: the weighted tier with the lowest
+// number of connections relative to its weight first, then all the tiers by
+// index
+func (t *tierSet) order() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	first := -1
+	for i, tier := range t.tiers {
+		if tier.Weight <= 0 || tier.Dialer == nil {
+			continue
+		}
+		// Comparing (live+1)/weight without dividing
+		if first < 0 || (t.live[i]+1)*t.tiers[first].Weight < (t.live[first]+1)*tier.Weight {
+			first = i
+		}
+	}
+
+	order := make([]int, 0, len(t.tiers))
+	if first >= 0 {
+		order = append(order, first)
+	}
+	for i, tier := range t.tiers {
+		if i != first && tier.Dialer != nil {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// forget removes a closed connection from its tier
+func (t *tierSet) forget(cc *grpc.ClientConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if i, ok := t.conns[cc]; ok {
+		t.live[i]--
+		delete(t.conns, cc)
+	}
+}
+
+// tier returns the index of the tier of a connection, -1 if it has none
+func (t *tierSet) tier(cc *grpc.ClientConn) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if i, ok := t.conns[cc]; ok {
+		return i
+	}
+	return -1
+}
+
+// Tier returns the index, in the WithTiers list, of the tier the connection
+// was created for. It's -1 if the pool has no tiers or the connection was
+// added with Put
+func (c *ClientConn) Tier() int {
+	if c == nil || c.ClientConn == nil || c.pool == nil || c.pool.tiers == nil {
+		return -1
+	}
+	return c.pool.tiers.tier(c.ClientConn)
+}
+
+// preferTier is the connection selector of WithTierPreference, picking the
+// idle connection of the first tier
+func (p *Pool) preferTier(candidates []*ClientConn) int {
+	best, bestTier := -1, -1
+	for i, c := range candidates {
+		tier := c.Tier()
+		if tier >= 0 && (bestTier < 0 || tier < bestTier) {
+			best, bestTier = i, tier
+		}
+	}
+	return best
+}
@@ -0,0 +1,98 @@
+package grpcpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func tierDialer(ctx context.Context) (*grpc.ClientConn, error) {
+	return grpc.Dial("example.com", grpc.WithInsecure())
+}
+
+func TestTiers(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), nil, WithCapacity(10), WithInitialConns(10),
+		WithTiers([]Tier{{Weight: 8, Dialer: tierDialer}, {Weight: 2, Dialer: tierDialer}}))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	var tiers [2]int
+	var conns []*ClientConn
+	for i := 0; i < 10; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		tiers[c.Tier()]++
+		conns = append(conns, c)
+	}
+	if tiers != [2]int{8, 2} {
+		t.Errorf("The connections were split %v but should be split [8 2]", tiers)
+	}
+
+	// A recycled connection is replaced in the same tier
+	var fallback *ClientConn
+	for _, c := range conns {
+		if c.Tier() == 1 {
+			fallback = c
+		}
+	}
+	fallback.Unhealthy()
+	fallback.Close()
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Errorf("Get returned an error: %s", err.Error())
+	}
+	if tier := c.Tier(); tier != 1 {
+		t.Errorf("The new connection tier was %d but should be 1", tier)
+	}
+}
+
+func TestTiersFailover(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), nil, WithCapacity(2), WithInitialConns(2),
+		WithTiers([]Tier{
+			{Weight: 1, Dialer: func(ctx context.Context) (*grpc.ClientConn, error) {
+				return nil, errors.New("primary is down")
+			}},
+			{Weight: 1, Dialer: tierDialer},
+		}))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		if tier := c.Tier(); tier != 1 {
+			t.Errorf("The connection tier was %d but should be 1", tier)
+		}
+	}
+}
+
+func TestTierPreference(t *testing.T) {
+	p, err := NewWithOptions(context.Background(), nil, WithCapacity(2), WithInitialConns(2),
+		WithCheckoutOrder(LIFO), WithTierPreference(),
+		WithTiers([]Tier{{Weight: 1, Dialer: tierDialer}, {Weight: 1, Dialer: tierDialer}}))
+	if err != nil {
+		t.Errorf("The pool returned an error: %s", err.Error())
+	}
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err.Error())
+		}
+		if tier := c.Tier(); tier != 0 {
+			t.Errorf("The connection tier was %d but should be 0", tier)
+		}
+		c.Close()
+	}
+}
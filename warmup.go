@@ -0,0 +1,90 @@
+package grpcpool
+
+import (
+	"context"
+	"time"
+)
+
+// warmUp creates n connections in the background for WithBackgroundWarmup,
+// each one taking the place of a connection not created yet. A failed dial
+// is retried with WithInitRetry, Get creating the connection otherwise. It
+// stops once ctx is canceled by the pool closing
+func (p *Pool) warmUp(ctx context.Context, n int) {
+	failed := 0
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		filled, err := p.createIdle(ctx)
+		if err != nil {
+			failed++
+			continue
+		}
+		if !filled {
+			return
+		}
+	}
+	p.retryInit(ctx, failed)
+}
+
+// retryInit creates the n initial connections whose dial failed, waiting
+// between the attempts from the WithInitRetry minimum backoff, doubled after
+// each failure up to the maximum one. It gives up once Get created the
+// connections instead, or ctx is canceled by the pool closing
+func (p *Pool) retryInit(ctx context.Context, n int) {
+	if p.initRetryMin <= 0 {
+		return
+	}
+
+	backoff := p.initRetryMin
+	for n > 0 {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		filled, err := p.createIdle(ctx)
+		if err != nil {
+			backoff *= 2
+			if backoff > p.initRetryMax {
+				backoff = p.initRetryMax
+			}
+			continue
+		}
+		if !filled {
+			return
+		}
+		n--
+		backoff = p.initRetryMin
+	}
+}
+
+// createIdle creates a connection taking the place of one not created yet.
+// It returns false if there is no such place anymore, Get having already
+// created all the connections or the pool being closed, the new connection
+// being closed then
+func (p *Pool) createIdle(ctx context.Context) (bool, error) {
+	cc, latency, err := p.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	p.track(cc, false)
+	if err := p.connectInit(ctx, cc); err != nil {
+		return false, err
+	}
+
+	clients := p.getClients()
+	ok := clients != nil && clients.fill(ClientConn{
+		ClientConn:    cc,
+		pool:          p,
+		timeUsed:      p.clock.Now(),
+		timeInitiated: p.clock.Now(),
+		maxLife:       p.connMaxLife(),
+		dialLatency:   latency,
+		generation:    p.currentGeneration(),
+	})
+	if !ok {
+		p.destroy(cc, recycleDiscarded)
+	}
+	return ok, nil
+}